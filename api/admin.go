@@ -0,0 +1,467 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"limit_service/config"
+	"limit_service/middleware"
+	"limit_service/tools"
+)
+
+// OverrideRequest 设置用户限速覆盖的请求结构体，rule 和 multiplier 只能设置一个
+type OverrideRequest struct {
+	Rule       string     `json:"rule"`       // 绝对规则，如 "100/3h"
+	Multiplier float64    `json:"multiplier"` // 倍率，如 2 表示额度翻倍
+	ExpiresAt  *time.Time `json:"expires_at"` // 过期时间，RFC3339格式
+	TTL        string     `json:"ttl"`        // 有效时长，如 "24h"，与expires_at二选一
+	Reason     string     `json:"reason"`
+}
+
+// OverridesResponse 用户限速覆盖列表响应结构体
+type OverridesResponse struct {
+	UserID    string                 `json:"user_id"`
+	Overrides []*tools.LimitOverride `json:"overrides"`
+}
+
+// CounterSetRequest 设置用户计数器的请求结构体
+type CounterSetRequest struct {
+	Value *float64 `json:"value"` // 使用量，积分计数器可以是小数
+	Unit  string   `json:"unit"`  // 只设置该计量单位的计数器，新建计数器时默认为 message
+}
+
+// CountersResponse 用户计数器列表响应结构体
+type CountersResponse struct {
+	UserID   string              `json:"user_id"`
+	Counters []tools.CounterInfo `json:"counters"`
+}
+
+// CounterResetResponse 重置用户计数器的响应结构体
+type CounterResetResponse struct {
+	UserID  string   `json:"user_id"`
+	Deleted []string `json:"deleted"`
+}
+
+// SessionRequest 为用户签发token的请求结构体
+type SessionRequest struct {
+	Signed bool `json:"signed"` // 签发在本地校验的签名token（JWT），需要配置 auth.hmac_secret
+}
+
+// SessionResponse 为用户签发token的响应结构体
+type SessionResponse struct {
+	UserID    string    `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// APIKeyRequest 为用户创建API key的请求结构体
+type APIKeyRequest struct {
+	Name string `json:"name"` // 备注，如客户端名称
+}
+
+// APIKeyResponse 为用户创建API key的响应结构体，key只在创建时返回一次
+type APIKeyResponse struct {
+	UserID string `json:"user_id"`
+	Key    string `json:"key"`
+	tools.APIKeyInfo
+}
+
+// APIKeysResponse 用户API key列表响应结构体
+type APIKeysResponse struct {
+	UserID string             `json:"user_id"`
+	Keys   []tools.APIKeyInfo `json:"keys"`
+}
+
+// SetupAdminRoutes 设置管理接口路由，未配置管理员账号时不开放
+func SetupAdminRoutes(router *gin.Engine) {
+	cfg := config.GetConfig().Admin
+	if cfg.Username == "" {
+		fmt.Println("未配置管理员账号，管理接口未开放")
+		return
+	}
+	admin := router.Group("/admin", middleware.AdminAuthMiddleware(cfg.Username, cfg.Password), middleware.AdminAuditMiddleware())
+
+	// 用户限速覆盖，key为覆盖的配置项：模型名、通配模式、group:组名、credits 或 *
+	admin.GET("/users/:uid/overrides", listOverridesHandler)
+	admin.PUT("/users/:uid/overrides/:key", setOverrideHandler)
+	admin.DELETE("/users/:uid/overrides/:key", deleteOverrideHandler)
+	admin.DELETE("/users/:uid/overrides", clearOverridesHandler)
+
+	// 用户计数器，name可以是模型名、模型别名、通配模式、group:组名 或 credits，可用 ?product= 限定产品
+	admin.GET("/users/:uid/counters", listCountersHandler)
+	admin.PUT("/users/:uid/counters", setCountersHandler)
+	admin.PUT("/users/:uid/counters/:name", setCountersHandler)
+	admin.DELETE("/users/:uid/counters", resetCountersHandler)
+	admin.DELETE("/users/:uid/counters/:name", resetCountersHandler)
+
+	// 用户在账号共享检测窗口内使用过的IP和设备
+	admin.GET("/users/:uid/sharing", sharingHandler)
+
+	// 用户的登录会话，可以签发新的token或吊销所有会话
+	admin.POST("/users/:uid/sessions", createSessionHandler)
+	admin.DELETE("/users/:uid/sessions", revokeSessionsHandler)
+
+	// 用户的API key，用于通过 Authorization: Bearer 认证，id为key的SHA-256
+	admin.GET("/users/:uid/api_keys", listAPIKeysHandler)
+	admin.POST("/users/:uid/api_keys", createAPIKeyHandler)
+	admin.DELETE("/users/:uid/api_keys/:id", revokeAPIKeyHandler)
+
+	// 车的健康状态，可以提前解除隔离
+	admin.GET("/cars/:carid/health", carHealthHandler)
+	admin.DELETE("/cars/:carid/quarantine", clearQuarantineHandler)
+
+	// GET /admin/quota/resolve?product=xxx&package=xxx&model=xxx 查看模型命中的限速规则，用于排查配置
+	admin.GET("/quota/resolve", resolveHandler)
+
+	// 重新加载限速配置（包括车权限矩阵），与发送SIGHUP相同
+	admin.POST("/reload", reloadHandler)
+
+	// 管理操作审计记录
+	admin.GET("/audit", adminAuditHandler)
+}
+
+// listOverridesHandler 返回用户当前生效的限速覆盖
+func listOverridesHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	overrides, err := tools.GetLimitOverrides(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, OverridesResponse{UserID: uid, Overrides: overrides})
+}
+
+// setOverrideHandler 设置用户某个配置项的限速覆盖
+func setOverrideHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	var req OverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求格式错误: " + err.Error()})
+		return
+	}
+
+	override := &tools.LimitOverride{
+		Key:        c.Param("key"),
+		Rule:       req.Rule,
+		Multiplier: req.Multiplier,
+		ExpiresAt:  req.ExpiresAt,
+		Reason:     req.Reason,
+	}
+	if req.TTL != "" {
+		if req.ExpiresAt != nil {
+			c.JSON(http.StatusBadRequest, AuditResponse{Error: "ttl 和 expires_at 只能设置一个"})
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, AuditResponse{Error: fmt.Sprintf("ttl 格式错误: %q", req.TTL)})
+			return
+		}
+		expiresAt := time.Now().Add(ttl)
+		override.ExpiresAt = &expiresAt
+	}
+	if err := override.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "限速覆盖无效: " + err.Error()})
+		return
+	}
+
+	if err := tools.SetLimitOverride(uid, override); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("设置限速覆盖 %s: rule=%q multiplier=%v expires_at=%v reason=%q",
+		override.Key, override.Rule, override.Multiplier, override.ExpiresAt, override.Reason))
+	c.JSON(http.StatusOK, override)
+}
+
+// deleteOverrideHandler 删除用户某个配置项的限速覆盖
+func deleteOverrideHandler(c *gin.Context) {
+	uid, key := c.Param("uid"), c.Param("key")
+	if err := tools.DeleteLimitOverrides(uid, key); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, "删除限速覆盖 "+key)
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// clearOverridesHandler 删除用户的所有限速覆盖
+func clearOverridesHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	if err := tools.DeleteLimitOverrides(uid); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, "删除所有限速覆盖")
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// adminProduct 读取管理请求中的 ?product= 参数，未知的产品返回400
+func adminProduct(c *gin.Context) (string, bool) {
+	product := strings.ToLower(c.Query("product"))
+	if product == "" {
+		return "", true
+	}
+	if _, err := tools.ResolveProduct(product, ""); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: err.Error()})
+		return "", false
+	}
+	return product, true
+}
+
+// listCountersHandler 返回用户所有计数器的使用量和剩余时间
+func listCountersHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	product, ok := adminProduct(c)
+	if !ok {
+		return
+	}
+	counters, err := tools.ListUserCounters(uid, product)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, CountersResponse{UserID: uid, Counters: counters})
+}
+
+// resetCountersHandler 删除用户某个模型或所有的计数器
+func resetCountersHandler(c *gin.Context) {
+	uid, name := c.Param("uid"), c.Param("name")
+	product, ok := adminProduct(c)
+	if !ok {
+		return
+	}
+	deleted, err := tools.ResetUserCounters(uid, product, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("重置计数器 %s", strings.Join(deleted, ", ")))
+	if deleted == nil {
+		deleted = []string{}
+	}
+	c.JSON(http.StatusOK, CounterResetResponse{UserID: uid, Deleted: deleted})
+}
+
+// setCountersHandler 把用户当前套餐下某个模型或所有已存在的计数器设为指定的使用量
+// 未指定产品时按模型名判断，没有模型名时使用默认产品
+func setCountersHandler(c *gin.Context) {
+	uid, name := c.Param("uid"), c.Param("name")
+	var req CounterSetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求格式错误: " + err.Error()})
+		return
+	}
+	if req.Value == nil || *req.Value < 0 {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "value 必须是非负数"})
+		return
+	}
+	switch req.Unit {
+	case "", tools.UnitMessage, tools.UnitToken, tools.UnitCredit:
+	default:
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: fmt.Sprintf("未知的计量单位: %q", req.Unit)})
+		return
+	}
+
+	product, ok := requestProduct(c, c.Query("product"), name)
+	if !ok {
+		return
+	}
+	pkg, ok := resolvePackage(c, uid, product)
+	if !ok {
+		return
+	}
+	counters, err := tools.SetUserCounters(pkg, name, req.Unit, *req.Value)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, tools.ErrCounterNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, AuditResponse{Error: err.Error()})
+		return
+	}
+
+	counterKeys := make([]string, len(counters))
+	for i, counter := range counters {
+		counterKeys[i] = counter.Key
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("设置计数器为 %g: %s", *req.Value, strings.Join(counterKeys, ", ")))
+	c.JSON(http.StatusOK, CountersResponse{UserID: uid, Counters: counters})
+}
+
+// sharingHandler 返回用户最近使用过的IP和设备
+func sharingHandler(c *gin.Context) {
+	report, err := tools.GetSharingReport(c.Param("uid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// createSessionHandler 为用户签发一个新的token，与用户已有的会话同时有效
+func createSessionHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	var req SessionRequest
+	// 请求体可以为空，默认创建会话token
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求格式错误: " + err.Error()})
+			return
+		}
+	}
+
+	var token string
+	var expiresAt time.Time
+	var err error
+	if req.Signed {
+		token, expiresAt, err = tools.IssueSignedToken(uid)
+	} else {
+		token, expiresAt, err = tools.CreateSession(uid)
+	}
+	if errors.Is(err, tools.ErrSigningDisabled) {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	// 审计记录中不保存token
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("为用户 %s 签发token（签名: %v），有效期至 %s", uid, req.Signed, expiresAt.Format(time.RFC3339)))
+	c.JSON(http.StatusOK, SessionResponse{UserID: uid, Token: token, ExpiresAt: expiresAt})
+}
+
+// revokeSessionsHandler 吊销用户的所有会话和旧的单一token
+func revokeSessionsHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	if err := tools.RevokeSessions(uid); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("吊销用户 %s 的所有会话", uid))
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// listAPIKeysHandler 返回用户的所有API key，不包含key本身
+func listAPIKeysHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	apiKeys, err := tools.ListAPIKeys(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, APIKeysResponse{UserID: uid, Keys: apiKeys})
+}
+
+// createAPIKeyHandler 为用户创建一个API key
+func createAPIKeyHandler(c *gin.Context) {
+	uid := c.Param("uid")
+	var req APIKeyRequest
+	// 请求体可以为空
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求格式错误: " + err.Error()})
+			return
+		}
+	}
+
+	apiKey, info, err := tools.CreateAPIKey(uid, req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	// 审计记录中不保存key
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("为用户 %s 创建API key %s", uid, info.ID))
+	c.JSON(http.StatusOK, APIKeyResponse{UserID: uid, Key: apiKey, APIKeyInfo: *info})
+}
+
+// revokeAPIKeyHandler 吊销用户的一个API key
+func revokeAPIKeyHandler(c *gin.Context) {
+	uid, id := c.Param("uid"), c.Param("id")
+	revoked, err := tools.RevokeAPIKey(uid, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, AuditResponse{Error: "API key不存在"})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("吊销用户 %s 的API key %s", uid, id))
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// carHealthHandler 返回车在统计窗口内的上报次数、错误次数和隔离状态
+func carHealthHandler(c *gin.Context) {
+	health, err := tools.GetCarHealth(c.Param("carid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+// clearQuarantineHandler 提前解除车的隔离
+func clearQuarantineHandler(c *gin.Context) {
+	carid := c.Param("carid")
+	quarantined, err := tools.ClearCarQuarantine(carid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, fmt.Sprintf("解除车 %s 的隔离（之前隔离中: %v）", carid, quarantined))
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// resolveHandler 返回指定套餐和模型解析后命中的规则
+func resolveHandler(c *gin.Context) {
+	model := c.Query("model")
+	if model == "" {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "缺少model参数"})
+		return
+	}
+	packageType := strings.ToLower(c.Query("package"))
+	if packageType == "" {
+		packageType = config.GetConfig().Policies.DefaultLevel
+	}
+
+	product, ok := requestProduct(c, c.Query("product"), model)
+	if !ok {
+		return
+	}
+
+	resolved := tools.ResolveLimitRule(product, packageType, model)
+	if resolved == nil {
+		c.JSON(http.StatusNotFound, AuditResponse{Error: "未配置速率限制"})
+		return
+	}
+	c.JSON(http.StatusOK, resolved)
+}
+
+// reloadHandler 重新加载限速配置，新配置有误时返回错误并继续使用当前配置
+func reloadHandler(c *gin.Context) {
+	if err := tools.InitStarLimit(); err != nil {
+		c.Set(middleware.AuditDetailKey, "重新加载限速配置失败")
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.Set(middleware.AuditDetailKey, "重新加载限速配置")
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// adminAuditHandler 返回最近的管理操作审计记录，?limit= 指定条数
+func adminAuditHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	entries, err := tools.GetAdminAudit(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"limit_service/config"
+	"limit_service/middleware"
 	"limit_service/tools"
 )
 
@@ -23,8 +27,39 @@ type AuditRequest struct {
 
 // AuditResponse 审核响应结构体
 type AuditResponse struct {
-	Status string `json:"status,omitempty"`
-	Error  string `json:"error,omitempty"`
+	Status string          `json:"status,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Code   string          `json:"code,omitempty"` // 拒绝的原因，见 tools.CarDenied*、tools.UserDenied* 常量
+	Cars   []tools.CarInfo `json:"cars,omitempty"` // 不能使用当前车时推荐切换的车
+
+	LeaseID       string `json:"lease_id,omitempty"`       // 本次请求占用的并发名额和额度预留，请求完成后由代理通过 /audit/complete 释放
+	ReservationID string `json:"reservation_id,omitempty"` // 本次扣除的额度，已记录在 lease_id 中，只用于展示和排查
+}
+
+// CarReportRequest 代理上报上游请求结果的请求结构体
+type CarReportRequest struct {
+	Outcome string `json:"outcome" binding:"required"` // success、429、401、5xx，也可以是具体的状态码
+}
+
+// carDeniedMessages 不能使用当前车时按原因给用户的提示
+var carDeniedMessages = map[string]string{
+	tools.CarDeniedNotAllowed: "请右上角切换线路",
+	tools.CarDeniedUnhealthy:  "当前线路暂时不可用，请右上角切换线路",
+	tools.CarDeniedBusy:       "当前线路繁忙，请稍后重试或切换线路",
+	tools.CarDeniedRPM:        "当前线路请求过于频繁，请稍后重试或切换线路",
+}
+
+// 请求完成回调中上游请求的结果
+const (
+	outcomeSuccess = "success" // 成功，保留扣除的额度
+	outcomeFailure = "failure" // 失败，退还扣除的额度
+)
+
+// CompleteRequest 请求完成回调的请求结构体
+// 用户、车和额度预留都取自 /audit 保存的记录，调用方只提交 lease_id
+type CompleteRequest struct {
+	LeaseID string `json:"lease_id" binding:"required"`
+	Outcome string `json:"outcome"` // success 或 failure，为空时为 success
 }
 
 // HelloResponse 欢迎响应结构体
@@ -34,49 +69,118 @@ type HelloResponse struct {
 
 // SetupAuditRoutes 设置审核相关路由
 func SetupAuditRoutes(router *gin.Engine) {
-	// POST /audit 审核接口
+	// POST /audit 审核接口，POST /audit/:product 指定产品，如 /audit/claude
 	router.POST("/audit", auditHandler)
-	
+	router.POST("/audit/:product", auditHandler)
+
 	// GET / 和 GET /audit 根路径和审核路径
 	router.GET("/", rootHandler)
 	router.GET("/audit", rootHandler)
+
+	setupServiceRoutes(router)
 }
 
-// auditHandler 处理审核请求
-func auditHandler(c *gin.Context) {
-	// 从中间件获取token和用户ID
-	xtoken, exists := c.Get("xtoken")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, AuditResponse{Error: "缺少xtoken"})
+// setupServiceRoutes 设置只允许代理调用的回调接口，使用 service.token 认证，未配置时不开放
+func setupServiceRoutes(router *gin.Engine) {
+	token := config.GetConfig().Service.Token
+	if token == "" {
+		fmt.Println("未配置 service.token，请求完成回调和车上报接口未开放，用户和车的并发上限不生效")
 		return
 	}
+	service := router.Group("", middleware.ServiceAuthMiddleware(token))
 
-	xuserid, exists := c.Get("xuserid")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, AuditResponse{Error: "缺少xuserid"})
-		return
-	}
+	// POST /audit/complete 请求完成回调，释放占用的用户和车并发名额，按上游结果确认或退还额度
+	service.POST("/audit/complete", completeHandler)
 
-	xtokenStr, ok := xtoken.(string)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, AuditResponse{Error: "xtoken格式错误"})
-		return
+	// POST /cars/:carid/report 代理上报车的上游请求结果，用于健康统计和自动隔离
+	service.POST("/cars/:carid/report", carReportHandler)
+}
+
+// verifyUser 从中间件获取登录信息并校验，失败时直接写入响应，见 middleware.ExtractCredentialsMiddleware
+// 返回: (用户ID, 是否校验通过)
+func verifyUser(c *gin.Context) (string, bool) {
+	// 没有在路由允许的来源中找到登录信息
+	mode := c.GetString(middleware.AuthModeKey)
+	if mode == "" {
+		unauthorized(c, http.StatusUnauthorized, "缺少登录信息")
+		return "", false
 	}
+	xtoken := c.GetString("xtoken")
 
-	xuseridStr, ok := xuserid.(string)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, AuditResponse{Error: "xuserid格式错误"})
-		return
+	// API key在Redis中直接映射到用户
+	if mode == config.AuthModeBearer {
+		xuserid, err := tools.LookupAPIKey(xtoken)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuditResponse{Error: "验证API key失败"})
+			return "", false
+		}
+		if xuserid == "" {
+			unauthorized(c, http.StatusUnauthorized, "API key无效")
+			return "", false
+		}
+		return xuserid, true
 	}
 
 	// 验证token
-	isValid, err := tools.VerifyTokenNoHeader(xuseridStr, xtokenStr)
+	xuserid := c.GetString("xuserid")
+	isValid, err := tools.VerifyTokenNoHeader(xuserid, xtoken)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, AuditResponse{Error: "验证token失败"})
-		return
+		return "", false
 	}
 	if !isValid {
+		// 过期的会话在正常用户中很常见（如浏览器中残留的旧Cookie），不计入IP的认证失败次数
 		c.JSON(http.StatusTooManyRequests, AuditResponse{Error: "登录信息已过期，请重新登录"})
+		return "", false
+	}
+
+	return xuserid, true
+}
+
+// unauthorized 返回认证失败的响应，并计入客户端IP的认证失败次数，见 middleware.IPLimitMiddleware
+func unauthorized(c *gin.Context, status int, msg string) {
+	c.Set(middleware.AuthFailedKey, true)
+	c.JSON(status, AuditResponse{Error: msg})
+}
+
+// requestProduct 确定请求使用的产品：指定的产品 > 模型名前缀 > 默认产品，产品未知时直接写入响应
+// 参数: requested - 请求中指定的产品，为空时使用路径参数或 X-Product header
+// 返回: (产品, 是否成功)
+func requestProduct(c *gin.Context, requested, model string) (string, bool) {
+	if requested == "" {
+		requested = c.Param("product")
+	}
+	if requested == "" {
+		requested = c.GetHeader("X-Product")
+	}
+	product, err := tools.ResolveProduct(requested, model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: err.Error()})
+		return "", false
+	}
+	return product, true
+}
+
+// resolvePackage 获取用户在产品下生效的套餐，失败时直接写入响应
+// 开启 policies.deny_unknown_level 时，套餐等级未在限速配置中定义返回403并提示联系客服
+func resolvePackage(c *gin.Context, xuserid, product string) (*tools.UserPackage, bool) {
+	pkg, err := tools.Packages.Resolve(xuserid, product)
+	if errors.Is(err, tools.ErrUnknownLevel) {
+		fmt.Printf("套餐等级未配置: %v\n", err)
+		c.JSON(http.StatusForbidden, AuditResponse{Error: "当前套餐暂不支持该服务，请联系客服"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: "获取用户套餐失败: " + err.Error()})
+		return nil, false
+	}
+	return pkg, true
+}
+
+// auditHandler 处理审核请求
+func auditHandler(c *gin.Context) {
+	xuseridStr, ok := verifyUser(c)
+	if !ok {
 		return
 	}
 
@@ -88,6 +192,15 @@ func auditHandler(c *gin.Context) {
 	}
 
 	model := auditRequest.Model
+	product, ok := requestProduct(c, "", model)
+	if !ok {
+		return
+	}
+	// 套餐信息只读取一次，限速和车权限校验共用
+	pkg, ok := resolvePackage(c, xuseridStr, product)
+	if !ok {
+		return
+	}
 	
 	// 获取prompt
 	var prompt string
@@ -103,20 +216,48 @@ func auditHandler(c *gin.Context) {
 
 	// 获取header信息
 	carid := strings.ReplaceAll(c.GetHeader("carid"), " ", "")
-	usertoken := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
 
 	fmt.Printf("carid: %s\n", carid)
-	fmt.Printf("usertoken: %s\n", usertoken)
 	fmt.Printf("prompt: %s\n", prompt)
 
+	// 记录用户的IP和设备，用于发现账号共享，超过上限时记录到用户的账号共享记录；检测失败不影响提问
+	sharing, err := tools.CheckSharing(pkg, c.ClientIP(), c.GetHeader("User-Agent"))
+	if err != nil {
+		fmt.Printf("账号共享检测失败: %v\n", err)
+	}
+	if sharing.Blocked() {
+		c.JSON(http.StatusForbidden, AuditResponse{Error: "检测到账号在多个网络或设备上同时使用，请勿共享账号", Code: tools.UserDeniedShared})
+		return
+	}
+
 	// 内容审核
 	if !tools.StarAudit(prompt) {
 		c.JSON(http.StatusBadRequest, AuditResponse{Error: "请珍惜账号, 不要提问违禁内容."})
 		return
 	}
 
+	// 占用用户的并发名额，同时进行的对话过多时不消耗额度
+	leaseID, acquired, err := tools.AcquireUserSlot(pkg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: "检查用户并发失败: " + err.Error()})
+		return
+	}
+	if !acquired {
+		c.JSON(http.StatusTooManyRequests, AuditResponse{Error: "同时进行的对话过多，请等待其他对话完成后重试", Code: tools.UserDeniedBusy})
+		return
+	}
+
+	// 请求没有通过之后的检查时释放用户并发名额，并退还已经扣除的额度
+	var reservationID string
+	served := false
+	defer func() {
+		if !served {
+			abandonRequest(xuseridStr, leaseID, reservationID)
+		}
+	}()
+
 	// 检查速率限制
-	isOk, limitMsg, err := tools.GetStarLimit(xuseridStr, model)
+	isOk, limitMsg, reservationID, err := tools.GetStarLimit(pkg, model, tools.EstimateTokens(prompt))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, AuditResponse{Error: "检查速率限制失败: " + err.Error()})
 		return
@@ -124,22 +265,144 @@ func auditHandler(c *gin.Context) {
 
 	if isOk {
 		// 校验用户权限是否能在该车提问（就算没过限速也要先看看能不能提问）
-		canUse, err := tools.VerifyUserAcard(xuseridStr, carid)
+		canUse, reason, err := tools.VerifyUserAcard(pkg, carid)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, AuditResponse{Error: "验证用户权限失败: " + err.Error()})
 			return
 		}
 
-		if canUse {
-			c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
-		} else {
-			c.JSON(http.StatusTooManyRequests, AuditResponse{Error: "请右上角切换线路"})
+		if !canUse {
+			carDenied(c, pkg, carid, reason)
+			return
+		}
+
+		// 占用车的请求频率和并发名额，与用户并发名额共用同一个ID
+		slot, reason, err := tools.AcquireCarSlot(carid, leaseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuditResponse{Error: "检查线路负载失败: " + err.Error()})
+			return
+		}
+		if slot == nil {
+			carDenied(c, pkg, carid, reason)
+			return
+		}
+		if leaseID == "" {
+			leaseID = slot.LeaseID
+		}
+
+		// 记录本次请求占用的名额和预留，完成回调只能按记录释放，不能指定其他用户或车
+		lease := &tools.RequestLease{ID: leaseID, UserID: xuseridStr, CarID: carid, ReservationID: reservationID, CreatedAt: time.Now()}
+		if err := tools.SaveRequestLease(lease); err != nil {
+			if _, releaseErr := tools.ReleaseCarSlot(carid, leaseID); releaseErr != nil {
+				fmt.Printf("释放车 %s 的并发名额失败: %v\n", carid, releaseErr)
+			}
+			c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+			return
 		}
+		served = true
+		c.JSON(http.StatusOK, AuditResponse{Status: "ok", LeaseID: lease.ID, ReservationID: reservationID})
 	} else {
 		c.JSON(http.StatusTooManyRequests, AuditResponse{Error: limitMsg})
 	}
 }
 
+// carDenied 返回不能使用当前车的429响应，附带原因和可以切换的车
+// 推荐失败不影响拒绝结果，只是不提供一键切换
+func carDenied(c *gin.Context, pkg *tools.UserPackage, carid, reason string) {
+	cars, err := tools.RecommendCars(pkg, carid)
+	if err != nil {
+		fmt.Printf("推荐可用车失败: %v\n", err)
+	}
+	c.JSON(http.StatusTooManyRequests, AuditResponse{Error: carDeniedMessages[reason], Code: reason, Cars: cars})
+}
+
+// abandonRequest 请求没有通过审核时释放用户并发名额并退还已经扣除的额度，失败只记录日志
+func abandonRequest(xuserid, leaseID, reservationID string) {
+	if _, err := tools.ReleaseUserSlot(xuserid, leaseID); err != nil {
+		fmt.Printf("释放用户 %s 的并发名额失败: %v\n", xuserid, err)
+	}
+	if reservationID == "" {
+		return
+	}
+	if _, err := tools.RefundReservation(xuserid, reservationID); err != nil {
+		fmt.Printf("退还用户 %s 的额度失败: %v\n", xuserid, err)
+	}
+}
+
+// carReportHandler 处理代理上报的车上游请求结果，只接受车目录中的车
+func carReportHandler(c *gin.Context) {
+	var req CarReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求参数错误: " + err.Error()})
+		return
+	}
+	if _, err := tools.RecordCarOutcome(c.Param("carid"), req.Outcome); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, tools.ErrUnknownOutcome):
+			status = http.StatusBadRequest
+		case errors.Is(err, tools.ErrUnknownCar):
+			status = http.StatusNotFound
+		}
+		c.JSON(status, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
+// completeHandler 处理代理的请求完成回调，按 /audit 保存的记录释放用户和车并发名额，并按上游结果确认或退还额度
+// 记录已经完成或过期时同样返回成功，回调可以安全地重试
+func completeHandler(c *gin.Context) {
+	var req CompleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: "请求参数错误: " + err.Error()})
+		return
+	}
+	if req.Outcome == "" {
+		req.Outcome = outcomeSuccess
+	}
+	if req.Outcome != outcomeSuccess && req.Outcome != outcomeFailure {
+		c.JSON(http.StatusBadRequest, AuditResponse{Error: fmt.Sprintf("outcome只能是%s或%s", outcomeSuccess, outcomeFailure)})
+		return
+	}
+
+	lease, err := tools.GetRequestLease(req.LeaseID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	if lease == nil {
+		c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+		return
+	}
+
+	// 同一个名额ID同时用于用户和车的并发名额
+	if _, err := tools.ReleaseUserSlot(lease.UserID, lease.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	if _, err := tools.ReleaseCarSlot(lease.CarID, lease.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	if lease.ReservationID != "" {
+		if req.Outcome == outcomeFailure {
+			_, err = tools.RefundReservation(lease.UserID, lease.ReservationID)
+		} else {
+			_, err = tools.ConfirmReservation(lease.UserID, lease.ReservationID)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+			return
+		}
+	}
+	if err := tools.DeleteRequestLease(lease.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, AuditResponse{Status: "ok"})
+}
+
 // rootHandler 处理根路径请求
 func rootHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, HelloResponse{Message: "Hello, Star Limt Server Is Ready"})
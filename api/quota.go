@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"limit_service/tools"
+)
+
+// QuotaResponse 额度查询响应结构体
+type QuotaResponse struct {
+	Quotas []tools.QuotaInfo `json:"quotas"`
+}
+
+// SetupQuotaRoutes 设置额度查询相关路由
+func SetupQuotaRoutes(router *gin.Engine) {
+	// GET /quota?product=xxx&model=xxx 查询当前用户的额度，model为空时返回套餐中所有模型
+	router.GET("/quota", quotaHandler)
+}
+
+// quotaHandler 处理额度查询请求
+func quotaHandler(c *gin.Context) {
+	xuseridStr, ok := verifyUser(c)
+	if !ok {
+		return
+	}
+
+	model := c.Query("model")
+	product, ok := requestProduct(c, c.Query("product"), model)
+	if !ok {
+		return
+	}
+
+	pkg, ok := resolvePackage(c, xuseridStr, product)
+	if !ok {
+		return
+	}
+
+	quotas, err := tools.GetStarQuota(pkg, model)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, AuditResponse{Error: "查询额度失败: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, QuotaResponse{Quotas: quotas})
+}
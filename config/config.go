@@ -1,49 +1,748 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigFile 默认配置文件路径，文件不存在时只使用默认值和环境变量
+const DefaultConfigFile = "./config.yaml"
+
+// Redis部署模式
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+// 套餐变化时计数器的迁移策略
+const (
+	TransitionReset = "reset" // 新套餐的计数器从0开始
+	TransitionCarry = "carry" // 沿用旧套餐已使用的次数
+	TransitionScale = "scale" // 按旧套餐的使用比例折算到新套餐
 )
 
+// 超时未确认的额度预留的处理策略
+const (
+	ReservationKeep   = "keep"   // 保留已扣除的额度
+	ReservationRefund = "refund" // 退还已扣除的额度
+)
+
+// 用户登录信息的来源
+const (
+	AuthModeCookie = "cookie" // Cookie中的 xuserid 和 xtoken
+	AuthModeHeader = "header" // X-User-Id 和 X-Token header
+	AuthModeBearer = "bearer" // Authorization: Bearer <API key>，API key在Redis中映射到用户
+)
+
+// ServerConfig HTTP服务配置
+type ServerConfig struct {
+	Port int    `yaml:"port"`
+	Mode string `yaml:"mode"` // Gin运行模式: debug、release、test
+
+	TrustedProxies  []string `yaml:"trusted_proxies"`   // 可信代理的IP或CIDR，只有来自这些地址的请求才读取客户端IP header
+	RemoteIPHeaders []string `yaml:"remote_ip_headers"` // 可信代理传递客户端IP的header，按顺序读取
+}
+
+// PathConfig 数据文件路径配置
+type PathConfig struct {
+	Keywords string `yaml:"keywords"` // 敏感词文件
+	Limit    string `yaml:"limit"`    // 限速规则文件
+}
+
 // RedisConfig Redis连接配置
 type RedisConfig struct {
-	Host     string
-	Port     int
-	Password string
-	DB       int
+	Mode     string   `yaml:"mode"`     // 部署模式: single、sentinel、cluster
+	Host     string   `yaml:"host"`     // 单机模式地址（未配置Addrs时使用）
+	Port     int      `yaml:"port"`     // 单机模式端口（未配置Addrs时使用）
+	Addrs    []string `yaml:"addrs"`    // 节点地址列表：单机为一个地址，哨兵为哨兵地址，集群为种子节点
+	Username string   `yaml:"username"` // ACL用户名
+	Password string   `yaml:"password"`
+	DB       int      `yaml:"db"` // 集群模式下必须为0
+
+	MasterName       string `yaml:"master_name"`       // 哨兵模式的主节点名称
+	SentinelPassword string `yaml:"sentinel_password"` // 哨兵节点密码
+
+	TLS           bool          `yaml:"tls"`             // 是否启用TLS
+	TLSSkipVerify bool          `yaml:"tls_skip_verify"` // 是否跳过证书校验（仅用于测试环境）
+	PoolSize      int           `yaml:"pool_size"`       // 每个节点的连接池大小，0表示使用驱动默认值
+	MinIdleConns  int           `yaml:"min_idle_conns"`
+	DialTimeout   time.Duration `yaml:"dial_timeout"`
+	ReadTimeout   time.Duration `yaml:"read_timeout"`
+	WriteTimeout  time.Duration `yaml:"write_timeout"`
+	PoolTimeout   time.Duration `yaml:"pool_timeout"`
+}
+
+// KeyConfig Redis键名配置
+// 部分键与主应用(Python)共享，前缀和模板需与主应用保持一致；
+// 模板中的 %s 依次替换为对应的参数，数量不可增减
+type KeyConfig struct {
+	Prefix  string `yaml:"prefix"`  // 所有键的公共前缀，可用于区分staging等命名空间
+	Version string `yaml:"version"` // 本服务自有键的版本号，非空时插入到自有键之前，用于键结构升级
+
+	// 与主应用共享的键
+	Token          string `yaml:"token"`           // 用户token，参数: 用户ID
+	ActivePackages string `yaml:"active_packages"` // 用户激活套餐，参数: 用户ID
+	CarStatus      string `yaml:"car_status"`      // 车状态，参数: 车ID
+
+	// 与主应用共享的限速键，不插入版本号
+	RateLimit        string `yaml:"rate_limit"`         // 限速计数器，参数: 用户ID、套餐、模型
+	RateLimitPackage string `yaml:"rate_limit_package"` // 用户上次使用的套餐，参数: 用户ID
+
+	// 本服务自有的键
+	RateLimitIndex string `yaml:"rate_limit_index"` // 用户所有计数器的索引，参数: 用户ID
+	AdminAudit     string `yaml:"admin_audit"`      // 管理操作审计日志，无参数
+	CarRPM         string `yaml:"car_rpm"`          // 车最近一分钟的请求记录，参数: 车ID
+	CarInflight    string `yaml:"car_inflight"`     // 车正在处理的请求，参数: 车ID
+	CarOutcomes    string `yaml:"car_outcomes"`     // 车最近的上游请求结果，参数: 车ID
+	CarErrors      string `yaml:"car_errors"`       // 车最近的上游错误，参数: 车ID
+	CarQuarantine  string `yaml:"car_quarantine"`   // 车的隔离状态，参数: 车ID
+	Reservation    string `yaml:"reservation"`      // 一次请求的额度预留，参数: 用户ID、预留ID
+	Reservations   string `yaml:"reservations"`     // 所有未确认的额度预留，无参数
+	UserInflight   string `yaml:"user_inflight"`    // 用户正在处理的请求，参数: 用户ID
+	UserIPs        string `yaml:"user_ips"`         // 用户最近使用的IP，参数: 用户ID
+	UserDevices    string `yaml:"user_devices"`     // 用户最近使用的设备，参数: 用户ID
+	UserSharing    string `yaml:"user_sharing"`     // 用户超过账号共享检测上限的记录，参数: 用户ID
+	IPRequests     string `yaml:"ip_requests"`      // IP在当前窗口的请求数，参数: IP
+	IPAuthFailures string `yaml:"ip_auth_failures"` // IP在当前窗口的认证失败次数，参数: IP
+	IPLockout      string `yaml:"ip_lockout"`       // IP的锁定状态，参数: IP
+	Sessions       string `yaml:"sessions"`         // 用户的所有会话token，参数: 用户ID
+	APIKey         string `yaml:"api_key"`          // API key对应的用户，参数: API key的SHA-256
+	UserAPIKeys    string `yaml:"user_api_keys"`    // 用户的所有API key，参数: 用户ID
+	LimitOverrides string `yaml:"limit_overrides"`  // 用户的限速覆盖，参数: 用户ID
+	Lease          string `yaml:"lease"`            // 通过审核的请求占用的名额和预留，参数: 名额ID
+}
+
+// PolicyConfig 业务策略配置
+type PolicyConfig struct {
+	DefaultLevel   string `yaml:"default_level"`   // 用户没有激活套餐时使用的套餐等级
+	DefaultProduct string `yaml:"default_product"` // 请求未指定产品且模型名不匹配任何产品前缀时使用的产品
+	Timezone       string `yaml:"timezone"`        // 对齐窗口未指定时区时使用的时区，也用于展示重置时间
+
+	PackageCacheTTL   time.Duration `yaml:"package_cache_ttl"`  // 用户套餐信息在进程内的缓存时间，0表示不缓存
+	PackageTransition string        `yaml:"package_transition"` // 套餐变化时计数器的迁移策略: reset、carry、scale
+	DenyUnknownLevel  bool          `yaml:"deny_unknown_level"` // 激活的等级在限速配置中不存在时拒绝请求，而不是按默认等级处理
+
+	CarDirectoryTTL    time.Duration `yaml:"car_directory_ttl"`   // 车列表在进程内的缓存时间，0表示每次重新扫描
+	CarRecommendations int           `yaml:"car_recommendations"` // 用户不能使用当前车时推荐的车数量，0表示不推荐
+	CarLeaseTimeout    time.Duration `yaml:"car_lease_timeout"`   // 车并发名额在没有收到完成回调时自动释放的时间
+
+	CarHealthWindow     time.Duration `yaml:"car_health_window"`      // 统计车上游错误率的滑动窗口
+	CarHealthMinSamples int           `yaml:"car_health_min_samples"` // 窗口内至少有这么多次上报才判断错误率
+	CarHealthErrorRate  float64       `yaml:"car_health_error_rate"`  // 错误率达到该值时隔离车，0到1之间
+	CarQuarantine       time.Duration `yaml:"car_quarantine"`         // 车被隔离的冷却时间
+
+	ReservationTimeout time.Duration `yaml:"reservation_timeout"` // 额度预留等待完成回调的时间
+	ReservationPolicy  string        `yaml:"reservation_policy"`  // 超时未确认的预留的处理策略: keep、refund
+
+	UserLeaseTimeout time.Duration `yaml:"user_lease_timeout"` // 用户并发名额在没有收到完成回调时自动释放的时间
+	SharingWindow    time.Duration `yaml:"sharing_window"`     // 统计用户使用的IP和设备数的滑动窗口
+}
+
+// AdminConfig 管理接口认证配置，用户名和密码都为空时不开放管理接口
+type AdminConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// minServiceTokenLength 服务间认证密钥的最小长度
+const minServiceTokenLength = 32
+
+// ServiceConfig 代理等内部服务调用回调接口的认证配置，密钥为空时不开放回调接口
+type ServiceConfig struct {
+	Token string `yaml:"token"` // 通过 X-Service-Token header 传递的共享密钥
+}
+
+// IPLimitConfig 按客户端IP的限速，在用户认证之前执行，次数为0表示不限制
+type IPLimitConfig struct {
+	Requests int           `yaml:"requests"` // 每个窗口内的请求数上限
+	Window   time.Duration `yaml:"window"`   // 请求数的统计窗口
+
+	AuthFailures      int           `yaml:"auth_failures"`       // 窗口内认证失败达到该次数时锁定IP
+	AuthFailureWindow time.Duration `yaml:"auth_failure_window"` // 认证失败次数的统计窗口
+	Lockout           time.Duration `yaml:"lockout"`             // 锁定时长
+
+	Allowlist []string `yaml:"allowlist"` // 不限速的IP或CIDR，如自己的代理服务器
+}
+
+// minHMACSecretLength 签名密钥的最小长度
+const minHMACSecretLength = 32
+
+// AuthConfig 用户token校验配置
+type AuthConfig struct {
+	HMACSecret  string        `yaml:"hmac_secret"`  // 签名token（JWT HS256或HMAC签名）的密钥，为空时只查询Redis中的token
+	SessionTTL  time.Duration `yaml:"session_ttl"`  // 服务签发的会话有效期，也是滑动续期延长到的时长
+	Sliding     bool          `yaml:"sliding"`      // 每次使用时把Redis中会话的有效期延长到 session_ttl
+	MaxSessions int           `yaml:"max_sessions"` // 每个用户同时有效的会话数上限，超过时淘汰最早过期的，0表示不限制
+
+	Modes  []string            `yaml:"modes"`  // 依次尝试的登录信息来源，见 AuthMode* 常量
+	Routes map[string][]string `yaml:"routes"` // 按路由覆盖登录信息来源，键为注册的路由，如 "/audit/:product"
 }
 
 // Config 应用配置
 type Config struct {
-	Redis RedisConfig
+	Server   ServerConfig `yaml:"server"`
+	Paths    PathConfig   `yaml:"paths"`
+	Redis    RedisConfig  `yaml:"redis"`
+	Keys     KeyConfig    `yaml:"keys"`
+	Policies PolicyConfig `yaml:"policies"`
+	Admin    AdminConfig  `yaml:"admin"`
+
+	IPLimit IPLimitConfig `yaml:"ip_limit"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Service ServiceConfig `yaml:"service"`
 }
 
-// GetConfig 获取应用配置
-func GetConfig() *Config {
+var (
+	currentConfig *Config
+	configMu      sync.Mutex
+)
+
+// Default 返回内置的默认配置
+func Default() *Config {
 	return &Config{
+		Server: ServerConfig{
+			Port: 19892,
+			Mode: "debug",
+
+			TrustedProxies:  []string{"127.0.0.1", "::1"},
+			RemoteIPHeaders: []string{"X-Forwarded-For", "X-Real-IP"},
+		},
+		Paths: PathConfig{
+			Keywords: "./data/keywords.txt",
+			Limit:    "./data/limit.json",
+		},
 		Redis: RedisConfig{
-			Host:     getEnvString("REDIS_HOST", "redis"),
-			Port:     getEnvInt("REDIS_PORT", 6379),
-			Password: getEnvString("REDIS_PASSWORD", ""),
-			DB:       getEnvInt("REDIS_DB", 0),
+			Mode:         RedisModeSingle,
+			Host:         "redis",
+			Port:         6379,
+			DialTimeout:  5 * time.Second,
+			ReadTimeout:  3 * time.Second,
+			WriteTimeout: 3 * time.Second,
+			PoolTimeout:  4 * time.Second,
+		},
+		Keys: KeyConfig{
+			Prefix:           "star:",
+			Token:            "xtoken_%s",
+			ActivePackages:   "user:%s:active_packages",
+			CarStatus:        "car_status:%s",
+			RateLimit:        "star_rate_limit:%s:%s:%s",
+			RateLimitPackage: "star_rate_limit_package:%s",
+			RateLimitIndex:   "star_rate_limit_index:%s",
+			AdminAudit:       "star_admin_audit",
+			CarRPM:           "car_rpm:%s",
+			CarInflight:      "car_inflight:%s",
+			CarOutcomes:      "car_outcomes:%s",
+			CarErrors:        "car_errors:%s",
+			CarQuarantine:    "car_quarantine:%s",
+			Reservation:      "star_reservation:%s:%s",
+			Reservations:     "star_reservations",
+			UserInflight:     "star_user_inflight:%s",
+			UserIPs:          "star_user_ips:%s",
+			UserDevices:      "star_user_devices:%s",
+			UserSharing:      "star_user_sharing:%s",
+			IPRequests:       "star_ip_requests:%s",
+			IPAuthFailures:   "star_ip_auth_failures:%s",
+			IPLockout:        "star_ip_lockout:%s",
+			Sessions:         "star_sessions:%s",
+			APIKey:           "star_api_key:%s",
+			UserAPIKeys:      "star_user_api_keys:%s",
+			LimitOverrides:   "user:%s:limit_overrides",
+			Lease:            "star_lease:%s",
+		},
+		Policies: PolicyConfig{
+			DefaultLevel:   "free",
+			DefaultProduct: "chatgpt",
+			Timezone:       "Local",
+
+			PackageCacheTTL:   5 * time.Second,
+			PackageTransition: TransitionReset,
+
+			CarDirectoryTTL:    30 * time.Second,
+			CarRecommendations: 3,
+			CarLeaseTimeout:    10 * time.Minute,
+
+			CarHealthWindow:     5 * time.Minute,
+			CarHealthMinSamples: 10,
+			CarHealthErrorRate:  0.5,
+			CarQuarantine:       10 * time.Minute,
+
+			ReservationTimeout: 10 * time.Minute,
+			ReservationPolicy:  ReservationKeep,
+
+			UserLeaseTimeout: 10 * time.Minute,
+			SharingWindow:    time.Hour,
 		},
+		IPLimit: IPLimitConfig{
+			Requests:          0,
+			Window:            time.Minute,
+			AuthFailures:      0,
+			AuthFailureWindow: 10 * time.Minute,
+			Lockout:           30 * time.Minute,
+		},
+		Auth: AuthConfig{
+			SessionTTL:  30 * 24 * time.Hour,
+			MaxSessions: 5,
+			Modes:       []string{AuthModeCookie, AuthModeHeader, AuthModeBearer},
+		},
+	}
+}
+
+// Load 加载应用配置：默认值 -> 配置文件 -> 环境变量，最后统一校验
+// path为空时依次使用 CONFIG_FILE 环境变量和 DefaultConfigFile；
+// 只有显式指定的配置文件不存在时才报错
+func Load(path string) (*Config, error) {
+	required := path != ""
+	if path == "" {
+		if envPath := os.Getenv("CONFIG_FILE"); envPath != "" {
+			path = envPath
+			required = true
+		} else {
+			path = DefaultConfigFile
+		}
+	}
+
+	cfg := Default()
+	if err := cfg.loadFile(path, required); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	configMu.Lock()
+	currentConfig = cfg
+	configMu.Unlock()
+	return cfg, nil
+}
+
+// GetConfig 获取应用配置
+// 启动时应先调用Load；未加载时按默认值和环境变量加载，加载失败则使用默认配置
+func GetConfig() *Config {
+	configMu.Lock()
+	cfg := currentConfig
+	configMu.Unlock()
+	if cfg != nil {
+		return cfg
+	}
+
+	cfg, err := Load("")
+	if err != nil {
+		fmt.Printf("警告：加载配置失败，使用默认配置: %v\n", err)
+		return Default()
+	}
+	return cfg
+}
+
+// loadFile 从YAML文件读取配置，未知字段视为错误
+func (c *Config) loadFile(path string, required bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("打开配置文件失败: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv 使用环境变量覆盖配置，格式错误的值直接报错而不是退回默认值
+func (c *Config) applyEnv() error {
+	env := &envReader{}
+
+	env.int("SERVER_PORT", &c.Server.Port)
+	env.str("GIN_MODE", &c.Server.Mode)
+	env.list("TRUSTED_PROXIES", &c.Server.TrustedProxies)
+	env.list("REMOTE_IP_HEADERS", &c.Server.RemoteIPHeaders)
+
+	env.str("KEYWORDS_PATH", &c.Paths.Keywords)
+	env.str("LIMIT_PATH", &c.Paths.Limit)
+
+	env.str("REDIS_MODE", &c.Redis.Mode)
+	env.str("REDIS_HOST", &c.Redis.Host)
+	env.int("REDIS_PORT", &c.Redis.Port)
+	env.list("REDIS_ADDRS", &c.Redis.Addrs)
+	env.str("REDIS_USERNAME", &c.Redis.Username)
+	env.str("REDIS_PASSWORD", &c.Redis.Password)
+	env.int("REDIS_DB", &c.Redis.DB)
+	env.str("REDIS_MASTER_NAME", &c.Redis.MasterName)
+	env.str("REDIS_SENTINEL_PASSWORD", &c.Redis.SentinelPassword)
+	env.bool("REDIS_TLS", &c.Redis.TLS)
+	env.bool("REDIS_TLS_SKIP_VERIFY", &c.Redis.TLSSkipVerify)
+	env.int("REDIS_POOL_SIZE", &c.Redis.PoolSize)
+	env.int("REDIS_MIN_IDLE_CONNS", &c.Redis.MinIdleConns)
+	env.duration("REDIS_DIAL_TIMEOUT", &c.Redis.DialTimeout)
+	env.duration("REDIS_READ_TIMEOUT", &c.Redis.ReadTimeout)
+	env.duration("REDIS_WRITE_TIMEOUT", &c.Redis.WriteTimeout)
+	env.duration("REDIS_POOL_TIMEOUT", &c.Redis.PoolTimeout)
+
+	env.str("REDIS_KEY_PREFIX", &c.Keys.Prefix)
+	env.str("REDIS_KEY_VERSION", &c.Keys.Version)
+	env.str("REDIS_KEY_TOKEN", &c.Keys.Token)
+	env.str("REDIS_KEY_ACTIVE_PACKAGES", &c.Keys.ActivePackages)
+	env.str("REDIS_KEY_CAR_STATUS", &c.Keys.CarStatus)
+	env.str("REDIS_KEY_RATE_LIMIT", &c.Keys.RateLimit)
+	env.str("REDIS_KEY_RATE_LIMIT_PACKAGE", &c.Keys.RateLimitPackage)
+	env.str("REDIS_KEY_RATE_LIMIT_INDEX", &c.Keys.RateLimitIndex)
+	env.str("REDIS_KEY_ADMIN_AUDIT", &c.Keys.AdminAudit)
+	env.str("REDIS_KEY_CAR_RPM", &c.Keys.CarRPM)
+	env.str("REDIS_KEY_CAR_INFLIGHT", &c.Keys.CarInflight)
+	env.str("REDIS_KEY_CAR_OUTCOMES", &c.Keys.CarOutcomes)
+	env.str("REDIS_KEY_CAR_ERRORS", &c.Keys.CarErrors)
+	env.str("REDIS_KEY_CAR_QUARANTINE", &c.Keys.CarQuarantine)
+	env.str("REDIS_KEY_RESERVATION", &c.Keys.Reservation)
+	env.str("REDIS_KEY_RESERVATIONS", &c.Keys.Reservations)
+	env.str("REDIS_KEY_USER_INFLIGHT", &c.Keys.UserInflight)
+	env.str("REDIS_KEY_USER_IPS", &c.Keys.UserIPs)
+	env.str("REDIS_KEY_USER_DEVICES", &c.Keys.UserDevices)
+	env.str("REDIS_KEY_USER_SHARING", &c.Keys.UserSharing)
+	env.str("REDIS_KEY_IP_REQUESTS", &c.Keys.IPRequests)
+	env.str("REDIS_KEY_IP_AUTH_FAILURES", &c.Keys.IPAuthFailures)
+	env.str("REDIS_KEY_IP_LOCKOUT", &c.Keys.IPLockout)
+	env.str("REDIS_KEY_SESSIONS", &c.Keys.Sessions)
+	env.str("REDIS_KEY_API_KEY", &c.Keys.APIKey)
+	env.str("REDIS_KEY_USER_API_KEYS", &c.Keys.UserAPIKeys)
+	env.str("REDIS_KEY_LIMIT_OVERRIDES", &c.Keys.LimitOverrides)
+	env.str("REDIS_KEY_LEASE", &c.Keys.Lease)
+
+	env.str("DEFAULT_LEVEL", &c.Policies.DefaultLevel)
+	env.str("DEFAULT_PRODUCT", &c.Policies.DefaultProduct)
+	env.str("TIMEZONE", &c.Policies.Timezone)
+	env.duration("PACKAGE_CACHE_TTL", &c.Policies.PackageCacheTTL)
+	env.str("PACKAGE_TRANSITION", &c.Policies.PackageTransition)
+	env.bool("DENY_UNKNOWN_LEVEL", &c.Policies.DenyUnknownLevel)
+	env.duration("CAR_DIRECTORY_TTL", &c.Policies.CarDirectoryTTL)
+	env.int("CAR_RECOMMENDATIONS", &c.Policies.CarRecommendations)
+	env.duration("CAR_LEASE_TIMEOUT", &c.Policies.CarLeaseTimeout)
+	env.duration("CAR_HEALTH_WINDOW", &c.Policies.CarHealthWindow)
+	env.int("CAR_HEALTH_MIN_SAMPLES", &c.Policies.CarHealthMinSamples)
+	env.float("CAR_HEALTH_ERROR_RATE", &c.Policies.CarHealthErrorRate)
+	env.duration("CAR_QUARANTINE", &c.Policies.CarQuarantine)
+	env.duration("RESERVATION_TIMEOUT", &c.Policies.ReservationTimeout)
+	env.str("RESERVATION_POLICY", &c.Policies.ReservationPolicy)
+	env.duration("USER_LEASE_TIMEOUT", &c.Policies.UserLeaseTimeout)
+	env.duration("SHARING_WINDOW", &c.Policies.SharingWindow)
+
+	env.str("ADMIN_USERNAME", &c.Admin.Username)
+	env.str("ADMIN_PASSWORD", &c.Admin.Password)
+	env.str("SERVICE_TOKEN", &c.Service.Token)
+
+	env.int("IP_LIMIT_REQUESTS", &c.IPLimit.Requests)
+	env.duration("IP_LIMIT_WINDOW", &c.IPLimit.Window)
+	env.int("IP_AUTH_FAILURES", &c.IPLimit.AuthFailures)
+	env.duration("IP_AUTH_FAILURE_WINDOW", &c.IPLimit.AuthFailureWindow)
+	env.duration("IP_LOCKOUT", &c.IPLimit.Lockout)
+	env.list("IP_ALLOWLIST", &c.IPLimit.Allowlist)
+
+	env.str("AUTH_HMAC_SECRET", &c.Auth.HMACSecret)
+	env.duration("AUTH_SESSION_TTL", &c.Auth.SessionTTL)
+	env.bool("AUTH_SLIDING", &c.Auth.Sliding)
+	env.int("AUTH_MAX_SESSIONS", &c.Auth.MaxSessions)
+	env.list("AUTH_MODES", &c.Auth.Modes)
+
+	if len(env.errs) > 0 {
+		return fmt.Errorf("环境变量配置错误: %s", strings.Join(env.errs, "; "))
+	}
+	return nil
+}
+
+// Validate 校验配置，一次返回所有错误
+func (c *Config) Validate() error {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		addErr("server.port 必须在 1-65535 之间，当前为 %d", c.Server.Port)
+	}
+	switch c.Server.Mode {
+	case "debug", "release", "test":
+	default:
+		addErr("server.mode 必须为 debug、release 或 test，当前为 %q", c.Server.Mode)
+	}
+	for i, proxy := range c.Server.TrustedProxies {
+		if _, err := ParseIPNet(proxy); err != nil {
+			addErr("server.trusted_proxies[%d] 不是有效的IP或CIDR: %q", i, proxy)
+		}
+	}
+
+	if c.Paths.Keywords == "" {
+		addErr("paths.keywords 不能为空")
+	}
+	if c.Paths.Limit == "" {
+		addErr("paths.limit 不能为空")
+	}
+
+	c.Redis.Mode = strings.ToLower(c.Redis.Mode)
+	switch c.Redis.Mode {
+	case RedisModeSingle:
+		if len(c.Redis.Addrs) > 1 {
+			addErr("redis.addrs 在单机模式下只能配置一个地址，当前为 %v", c.Redis.Addrs)
+		}
+		if len(c.Redis.Addrs) == 0 && (c.Redis.Port <= 0 || c.Redis.Port > 65535) {
+			addErr("redis.port 必须在 1-65535 之间，当前为 %d", c.Redis.Port)
+		}
+	case RedisModeSentinel:
+		if len(c.Redis.Addrs) == 0 {
+			addErr("redis.addrs 在哨兵模式下必须配置哨兵地址")
+		}
+		if c.Redis.MasterName == "" {
+			addErr("redis.master_name 在哨兵模式下不能为空")
+		}
+	case RedisModeCluster:
+		if len(c.Redis.Addrs) == 0 {
+			addErr("redis.addrs 在集群模式下必须配置种子节点地址")
+		}
+		if c.Redis.DB != 0 {
+			addErr("redis.db 在集群模式下必须为0，当前为 %d", c.Redis.DB)
+		}
+	default:
+		addErr("redis.mode 必须为 single、sentinel 或 cluster，当前为 %q", c.Redis.Mode)
+	}
+	if c.Redis.DB < 0 {
+		addErr("redis.db 不能为负数，当前为 %d", c.Redis.DB)
+	}
+	if c.Redis.PoolSize < 0 {
+		addErr("redis.pool_size 不能为负数，当前为 %d", c.Redis.PoolSize)
+	}
+	if c.Redis.MinIdleConns < 0 {
+		addErr("redis.min_idle_conns 不能为负数，当前为 %d", c.Redis.MinIdleConns)
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"dial_timeout", c.Redis.DialTimeout},
+		{"read_timeout", c.Redis.ReadTimeout},
+		{"write_timeout", c.Redis.WriteTimeout},
+		{"pool_timeout", c.Redis.PoolTimeout},
+	}
+	for _, t := range timeouts {
+		if t.value < 0 {
+			addErr("redis.%s 不能为负数，当前为 %s", t.name, t.value)
+		}
+	}
+
+	c.Policies.DefaultLevel = strings.ToLower(c.Policies.DefaultLevel)
+	if c.Policies.DefaultLevel == "" {
+		addErr("policies.default_level 不能为空")
+	}
+	c.Policies.DefaultProduct = strings.ToLower(c.Policies.DefaultProduct)
+	if c.Policies.DefaultProduct == "" {
+		addErr("policies.default_product 不能为空")
+	}
+	if _, err := time.LoadLocation(c.Policies.Timezone); err != nil {
+		addErr("policies.timezone 不是有效的时区: %v", err)
+	}
+	if c.Policies.PackageCacheTTL < 0 {
+		addErr("policies.package_cache_ttl 不能为负数，当前为 %s", c.Policies.PackageCacheTTL)
+	}
+	switch c.Policies.PackageTransition {
+	case TransitionReset, TransitionCarry, TransitionScale:
+	default:
+		addErr("policies.package_transition 只能是 %s、%s 或 %s，当前为 %q", TransitionReset, TransitionCarry, TransitionScale, c.Policies.PackageTransition)
+	}
+	if c.Policies.CarDirectoryTTL < 0 {
+		addErr("policies.car_directory_ttl 不能为负数，当前为 %s", c.Policies.CarDirectoryTTL)
+	}
+	if c.Policies.CarRecommendations < 0 {
+		addErr("policies.car_recommendations 不能为负数，当前为 %d", c.Policies.CarRecommendations)
+	}
+	if c.Policies.CarLeaseTimeout <= 0 {
+		addErr("policies.car_lease_timeout 必须大于0，当前为 %s", c.Policies.CarLeaseTimeout)
+	}
+	if c.Policies.CarHealthWindow <= 0 {
+		addErr("policies.car_health_window 必须大于0，当前为 %s", c.Policies.CarHealthWindow)
+	}
+	if c.Policies.CarHealthMinSamples < 1 {
+		addErr("policies.car_health_min_samples 必须大于0，当前为 %d", c.Policies.CarHealthMinSamples)
+	}
+	if c.Policies.CarHealthErrorRate <= 0 || c.Policies.CarHealthErrorRate > 1 {
+		addErr("policies.car_health_error_rate 必须在 (0, 1] 之间，当前为 %v", c.Policies.CarHealthErrorRate)
+	}
+	if c.Policies.CarQuarantine <= 0 {
+		addErr("policies.car_quarantine 必须大于0，当前为 %s", c.Policies.CarQuarantine)
+	}
+	if c.Policies.ReservationTimeout <= 0 {
+		addErr("policies.reservation_timeout 必须大于0，当前为 %s", c.Policies.ReservationTimeout)
+	}
+	switch c.Policies.ReservationPolicy {
+	case ReservationKeep, ReservationRefund:
+	default:
+		addErr("policies.reservation_policy 只能是 %s 或 %s，当前为 %q", ReservationKeep, ReservationRefund, c.Policies.ReservationPolicy)
+	}
+	if c.Policies.UserLeaseTimeout <= 0 {
+		addErr("policies.user_lease_timeout 必须大于0，当前为 %s", c.Policies.UserLeaseTimeout)
+	}
+	if c.Policies.SharingWindow <= 0 {
+		addErr("policies.sharing_window 必须大于0，当前为 %s", c.Policies.SharingWindow)
 	}
+
+	if (c.Admin.Username == "") != (c.Admin.Password == "") {
+		addErr("admin.username 和 admin.password 必须同时配置或同时为空")
+	}
+	if c.Service.Token != "" && len(c.Service.Token) < minServiceTokenLength {
+		addErr("service.token 长度不能少于 %d 个字符", minServiceTokenLength)
+	}
+
+	if c.IPLimit.Requests < 0 || c.IPLimit.AuthFailures < 0 {
+		addErr("ip_limit.requests 和 ip_limit.auth_failures 不能为负数")
+	}
+	if c.IPLimit.Requests > 0 && c.IPLimit.Window <= 0 {
+		addErr("ip_limit.window 必须大于0，当前为 %s", c.IPLimit.Window)
+	}
+	if c.IPLimit.AuthFailures > 0 && (c.IPLimit.AuthFailureWindow <= 0 || c.IPLimit.Lockout <= 0) {
+		addErr("ip_limit.auth_failure_window 和 ip_limit.lockout 必须大于0")
+	}
+	for i, entry := range c.IPLimit.Allowlist {
+		if _, err := ParseIPNet(entry); err != nil {
+			addErr("ip_limit.allowlist[%d] 不是有效的IP或CIDR: %q", i, entry)
+		}
+	}
+
+	if c.Auth.HMACSecret != "" && len(c.Auth.HMACSecret) < minHMACSecretLength {
+		addErr("auth.hmac_secret 长度不能少于 %d 个字符", minHMACSecretLength)
+	}
+	if c.Auth.SessionTTL <= 0 {
+		addErr("auth.session_ttl 必须大于0，当前为 %s", c.Auth.SessionTTL)
+	}
+	if c.Auth.MaxSessions < 0 {
+		addErr("auth.max_sessions 不能为负数，当前为 %d", c.Auth.MaxSessions)
+	}
+	validateAuthModes("auth.modes", c.Auth.Modes, addErr)
+	routes := make([]string, 0, len(c.Auth.Routes))
+	for route := range c.Auth.Routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		validateAuthModes(fmt.Sprintf("auth.routes[%s]", route), c.Auth.Routes[route], addErr)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("配置校验失败: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-// getEnvString 获取字符串环境变量，如果不存在则返回默认值
-func getEnvString(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// validateAuthModes 校验登录信息来源列表
+func validateAuthModes(field string, modes []string, addErr func(format string, args ...interface{})) {
+	if len(modes) == 0 {
+		addErr("%s 不能为空", field)
+		return
+	}
+	for i, mode := range modes {
+		switch mode {
+		case AuthModeCookie, AuthModeHeader, AuthModeBearer:
+		default:
+			addErr("%s[%d] 只能是 %s、%s 或 %s，当前为 %q", field, i, AuthModeCookie, AuthModeHeader, AuthModeBearer, mode)
+		}
 	}
-	return defaultValue
 }
 
-// getEnvInt 获取整数环境变量，如果不存在或转换失败则返回默认值
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// ParseIPNet 解析IP或CIDR，单个IP视为只包含该IP的网段
+func ParseIPNet(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
 		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
 	}
-	return defaultValue
-} 
\ No newline at end of file
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+// envReader 读取环境变量并记录格式错误
+type envReader struct {
+	errs []string
+}
+
+// str 读取字符串环境变量，未设置时保持原值
+func (e *envReader) str(key string, dst *string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = value
+	}
+}
+
+// int 读取整数环境变量
+func (e *envReader) int(key string, dst *int) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		intValue, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Sprintf("%s=%q 不是有效的整数", key, value))
+			return
+		}
+		*dst = intValue
+	}
+}
+
+// float 读取浮点数环境变量
+func (e *envReader) float(key string, dst *float64) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		floatValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Sprintf("%s=%q 不是有效的数字", key, value))
+			return
+		}
+		*dst = floatValue
+	}
+}
+
+// bool 读取布尔环境变量
+func (e *envReader) bool(key string, dst *bool) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		boolValue, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Sprintf("%s=%q 不是有效的布尔值", key, value))
+			return
+		}
+		*dst = boolValue
+	}
+}
+
+// duration 读取时长环境变量（如 "3s"、"500ms"）
+func (e *envReader) duration(key string, dst *time.Duration) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Sprintf("%s=%q 不是有效的时长", key, value))
+			return
+		}
+		*dst = d
+	}
+}
+
+// list 读取逗号分隔的列表环境变量，忽略空项
+func (e *envReader) list(key string, dst *[]string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*dst = list
+	}
+}
@@ -1,16 +1,31 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	_ "time/tzdata" // 内嵌时区数据，alpine镜像中没有系统时区库
 
 	"github.com/gin-gonic/gin"
 	"limit_service/api"
+	"limit_service/config"
 	"limit_service/middleware"
 	"limit_service/tools"
 )
 
 func main() {
+	configPath := flag.String("config", "", "配置文件路径，默认读取CONFIG_FILE环境变量或"+config.DefaultConfigFile)
+	flag.Parse()
+
+	// 加载配置，配置错误时直接退出
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("加载配置失败: %v", err)
+	}
+
 	// 初始化Redis连接
 	if err := tools.InitRedis(); err != nil {
 		log.Fatalf("初始化Redis失败: %v", err)
@@ -26,19 +41,54 @@ func main() {
 		log.Fatalf("初始化限速配置失败: %v", err)
 	}
 
+	// 收到SIGHUP时重新加载限速配置
+	go reloadOnSignal()
+
+	// 初始化套餐解析器
+	tools.InitPackageResolver()
+
+	// 初始化车目录
+	tools.InitCarDirectory()
+
+	// 定期处理超时未确认的额度预留
+	tools.StartReservationSweeper()
+
 	// 创建Gin路由器
-	// 在生产环境中，可以使用gin.SetMode(gin.ReleaseMode)
+	gin.SetMode(cfg.Server.Mode)
 	router := gin.Default()
 
-	// 添加cookie提取中间件
-	router.Use(middleware.ExtractCookiesMiddleware())
+	// 只信任来自可信代理的客户端IP header，用于账号共享检测和审计记录
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatalf("设置可信代理失败: %v", err)
+	}
+	router.RemoteIPHeaders = cfg.Server.RemoteIPHeaders
+
+	// 按客户端IP限速，需要在认证之前
+	router.Use(middleware.IPLimitMiddleware(cfg.IPLimit))
+
+	// 按 auth.modes 和 auth.routes 从Cookie、header或API key中提取登录信息
+	router.Use(middleware.ExtractCredentialsMiddleware(cfg.Auth))
 
 	// 设置路由
 	api.SetupAuditRoutes(router)
+	api.SetupQuotaRoutes(router)
+	api.SetupAdminRoutes(router)
 
 	// 启动服务器
-	fmt.Println("服务器启动在端口 19892")
-	if err := router.Run(":19892"); err != nil {
+	addr := fmt.Sprintf(":%d", cfg.Server.Port)
+	fmt.Printf("服务器启动在端口 %d\n", cfg.Server.Port)
+	if err := router.Run(addr); err != nil {
 		log.Fatalf("启动服务器失败: %v", err)
 	}
-} 
\ No newline at end of file
+}
+
+// reloadOnSignal 每次收到SIGHUP时重新加载限速配置（包括车权限矩阵），新配置有误时继续使用当前配置
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := tools.InitStarLimit(); err != nil {
+			fmt.Printf("重新加载限速配置失败，继续使用当前配置: %v\n", err)
+		}
+	}
+}
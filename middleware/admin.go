@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"limit_service/tools"
+)
+
+// AdminAuthMiddleware 管理接口的Basic认证中间件
+// 用户名和密码使用常量时间比较，避免通过响应时间猜测密码
+func AdminAuthMiddleware(username, password string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, pass, ok := c.Request.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1
+		if !ok || !userMatch || !passMatch {
+			c.Set(AuthFailedKey, true)
+			c.Header("WWW-Authenticate", `Basic realm="admin"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "管理员认证失败"})
+			return
+		}
+
+		// 记录操作的管理员，供后续处理器使用
+		c.Set("admin", user)
+		c.Next()
+	}
+}
+
+// AuditDetailKey 处理器通过 c.Set 记录操作详情时使用的键，由 AdminAuditMiddleware 写入审计记录
+const AuditDetailKey = "audit_detail"
+
+// adminAuditPath 查看审计记录的接口，本身不记录，避免查看审计记录把较早的记录挤出列表
+const adminAuditPath = "/admin/audit"
+
+// AdminAuditMiddleware 记录所有管理操作，包括查看用户数据的请求和失败的请求
+// 需要放在 AdminAuthMiddleware 之后，审计记录写入失败只输出日志，不影响响应
+func AdminAuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method == http.MethodGet && c.FullPath() == adminAuditPath {
+			return
+		}
+
+		entry := tools.AdminAuditEntry{
+			Time:     time.Now(),
+			Admin:    c.GetString("admin"),
+			Method:   c.Request.Method,
+			Path:     c.Request.URL.RequestURI(),
+			UserID:   c.Param("uid"),
+			Detail:   c.GetString(AuditDetailKey),
+			Status:   c.Writer.Status(),
+			ClientIP: c.ClientIP(),
+		}
+		if err := tools.RecordAdminAudit(entry); err != nil {
+			fmt.Printf("记录管理操作失败: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"limit_service/config"
+)
+
+// AuthModeKey 通过 c.Set 设置的登录信息来源，见 config.AuthMode* 常量；没有找到登录信息时不设置
+// 来源为cookie和header时同时设置 xuserid 和 xtoken，为bearer时只设置 xtoken（API key），由处理器查询对应的用户
+const AuthModeKey = "auth_mode"
+
+// credentialExtractor 从请求中提取一种来源的登录信息，返回: (用户ID, token, 是否找到)
+type credentialExtractor func(c *gin.Context) (string, string, bool)
+
+// credentialExtractors 各来源的登录信息提取方式
+var credentialExtractors = map[string]credentialExtractor{
+	config.AuthModeCookie: cookieCredentials,
+	config.AuthModeHeader: headerCredentials,
+	config.AuthModeBearer: bearerCredentials,
+}
+
+// ExtractCredentialsMiddleware 按配置的来源依次提取登录信息，使用第一个找到的来源
+// 路由在 auth.routes 中配置了来源时使用路由的配置，否则使用 auth.modes
+// 只提取不校验，没有找到登录信息时继续处理，由需要登录的处理器返回401
+func ExtractCredentialsMiddleware(cfg config.AuthConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		modes, exists := cfg.Routes[c.FullPath()]
+		if !exists {
+			modes = cfg.Modes
+		}
+		for _, mode := range modes {
+			extract, exists := credentialExtractors[mode]
+			if !exists {
+				continue
+			}
+			if xuserid, xtoken, found := extract(c); found {
+				c.Set(AuthModeKey, mode)
+				if xuserid != "" {
+					c.Set("xuserid", xuserid)
+				}
+				c.Set("xtoken", xtoken)
+				break
+			}
+		}
+		c.Next()
+	}
+}
+
+// cookieCredentials 从Cookie中的 xuserid 和 xtoken 提取登录信息
+func cookieCredentials(c *gin.Context) (string, string, bool) {
+	cookieString := c.GetHeader("cookie")
+	if cookieString == "" {
+		return "", "", false
+	}
+	cookies := parseCookieString(cookieString)
+	xuserid, xtoken := cookies["xuserid"], cookies["xtoken"]
+	return xuserid, xtoken, xuserid != "" && xtoken != ""
+}
+
+// headerCredentials 从 X-User-Id 和 X-Token header 提取登录信息，供不能发送Cookie的API客户端使用
+func headerCredentials(c *gin.Context) (string, string, bool) {
+	xuserid := strings.TrimSpace(c.GetHeader("X-User-Id"))
+	xtoken := strings.TrimSpace(c.GetHeader("X-Token"))
+	return xuserid, xtoken, xuserid != "" && xtoken != ""
+}
+
+// bearerCredentials 从 Authorization: Bearer header 提取API key
+func bearerCredentials(c *gin.Context) (string, string, bool) {
+	authorization := c.GetHeader("Authorization")
+	if len(authorization) < len("Bearer ") || !strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return "", "", false
+	}
+	apiKey := strings.TrimSpace(authorization[len("Bearer "):])
+	return "", apiKey, apiKey != ""
+}
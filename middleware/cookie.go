@@ -4,33 +4,13 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"limit_service/config"
 )
 
-// ExtractCookiesMiddleware 提取cookies中间件
-// 对应Python中的extract_cookies_middleware函数
+// ExtractCookiesMiddleware 提取cookies中间件，只从Cookie中提取登录信息
+// 对应Python中的extract_cookies_middleware函数，需要其他来源时使用 ExtractCredentialsMiddleware
 func ExtractCookiesMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// 获取cookie字符串
-		cookieString := c.GetHeader("cookie")
-		
-		// 解析cookies
-		xtoken := ""
-		xuserid := ""
-		
-		if cookieString != "" {
-			// 解析cookie字符串
-			cookies := parseCookieString(cookieString)
-			xtoken = cookies["xtoken"]
-			xuserid = cookies["xuserid"]
-		}
-
-		// 将解析的值存储到context中，供后续处理器使用
-		c.Set("xtoken", xtoken)
-		c.Set("xuserid", xuserid)
-
-		// 继续处理下一个中间件或处理器
-		c.Next()
-	}
+	return ExtractCredentialsMiddleware(config.AuthConfig{Modes: []string{config.AuthModeCookie}})
 }
 
 // parseCookieString 解析cookie字符串
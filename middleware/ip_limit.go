@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"limit_service/config"
+	"limit_service/tools"
+)
+
+// AuthFailedKey 处理器认证失败时通过 c.Set 设置为true，由 IPLimitMiddleware 计入IP的认证失败次数
+const AuthFailedKey = "auth_failed"
+
+// ipDeniedMessages IP被拒绝时的提示
+var ipDeniedMessages = map[string]string{
+	tools.IPDeniedLocked: "认证失败次数过多，请稍后再试",
+	tools.IPDeniedRate:   "请求过于频繁，请稍后再试",
+}
+
+// IPLimitMiddleware 按客户端IP限速的中间件，需要放在认证之前，对未登录的请求同样生效
+// 客户端IP通过 c.ClientIP() 获取，只在请求来自可信代理时读取代理传递的header；allowlist中的IP不限速
+// Redis不可用时放行请求，只输出日志；请求数和认证失败次数都不限制时不做任何检查
+func IPLimitMiddleware(cfg config.IPLimitConfig) gin.HandlerFunc {
+	if cfg.Requests == 0 && cfg.AuthFailures == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	allowlist := make([]*net.IPNet, 0, len(cfg.Allowlist))
+	for _, entry := range cfg.Allowlist {
+		// 配置加载时已经校验过格式
+		if ipNet, err := config.ParseIPNet(entry); err == nil {
+			allowlist = append(allowlist, ipNet)
+		}
+	}
+
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if ipAllowed(allowlist, ip) {
+			c.Next()
+			return
+		}
+
+		reason, wait, err := tools.CheckIPRequest(ip)
+		if err != nil {
+			fmt.Printf("IP限速检查失败，放行请求: %v\n", err)
+		} else if reason != "" {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": ipDeniedMessages[reason], "code": reason})
+			return
+		}
+
+		c.Next()
+
+		if !c.GetBool(AuthFailedKey) {
+			return
+		}
+		locked, err := tools.RecordAuthFailure(ip)
+		if err != nil {
+			fmt.Printf("记录IP认证失败失败: %v\n", err)
+		}
+		if locked {
+			fmt.Printf("IP %s 认证失败次数过多，锁定 %s\n", ip, cfg.Lockout)
+		}
+	}
+}
+
+// ipAllowed 判断IP是否在不限速的网段中
+func ipAllowed(allowlist []*net.IPNet, ip string) bool {
+	if len(allowlist) == 0 {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range allowlist {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServiceTokenHeader 代理等内部服务传递共享密钥的header
+const ServiceTokenHeader = "X-Service-Token"
+
+// ServiceAuthMiddleware 内部服务回调接口的认证中间件，只接受配置的 service.token
+// 用户的Cookie、token和API key都不能通过，密钥使用常量时间比较
+func ServiceAuthMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := c.GetHeader(ServiceTokenHeader)
+		if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.Set(AuthFailedKey, true)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "服务认证失败"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"limit_service/middleware"
+	"limit_service/tools"
+)
+
+// TestAdminAuditReads 测试查看用户数据的管理请求同样记录审计，查看审计记录本身不记录
+func TestAdminAuditReads(t *testing.T) {
+	setupTestRedis(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	admin := router.Group("/admin", middleware.AdminAuthMiddleware("admin", "secret"), middleware.AdminAuditMiddleware())
+	ok := func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) }
+	admin.GET("/users/:uid/counters", ok)
+	admin.DELETE("/users/:uid/counters", ok)
+	admin.GET("/audit", ok)
+
+	for _, r := range []struct{ method, path string }{
+		{http.MethodGet, "/admin/users/12345/counters"},
+		{http.MethodDelete, "/admin/users/12345/counters"},
+		{http.MethodGet, "/admin/audit"},
+	} {
+		req := httptest.NewRequest(r.method, r.path, nil)
+		req.SetBasicAuth("admin", "secret")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries, err := tools.GetAdminAudit(10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		// 最近的记录在前
+		assert.Equal(t, http.MethodDelete, entries[0].Method)
+		assert.Equal(t, http.MethodGet, entries[1].Method)
+		assert.Equal(t, "12345", entries[1].UserID)
+		assert.Equal(t, "admin", entries[1].Admin)
+	}
+}
@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/api"
+	"limit_service/config"
+	"limit_service/middleware"
+)
+
+// credentialsResult 测试路由返回的中间件提取结果
+type credentialsResult struct {
+	Mode    string `json:"mode"`
+	UserID  string `json:"xuserid"`
+	Token   string `json:"xtoken"`
+	Present bool   `json:"present"`
+}
+
+// setupAuthRouter 创建使用给定登录信息来源的路由，/whoami 和 /items/:id 返回提取到的登录信息，/quota 需要登录
+func setupAuthRouter(t *testing.T, cfg config.AuthConfig) *gin.Engine {
+	setupTestRedis(t)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.ExtractCredentialsMiddleware(cfg))
+	whoami := func(c *gin.Context) {
+		_, present := c.Get(middleware.AuthModeKey)
+		c.JSON(http.StatusOK, credentialsResult{
+			Mode:    c.GetString(middleware.AuthModeKey),
+			UserID:  c.GetString("xuserid"),
+			Token:   c.GetString("xtoken"),
+			Present: present,
+		})
+	}
+	router.GET("/whoami", whoami)
+	router.GET("/items/:id", whoami)
+	api.SetupQuotaRoutes(router)
+	return router
+}
+
+// extractCredentials 发送请求并返回中间件提取到的登录信息
+func extractCredentials(t *testing.T, router *gin.Engine, path string, header map[string]string) credentialsResult {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var result credentialsResult
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+// 各来源的登录信息
+var (
+	cookieAuth = map[string]string{"Cookie": "xuserid=u1; xtoken=cookie-token"}
+	headerAuth = map[string]string{"X-User-Id": "u2", "X-Token": "header-token"}
+	bearerAuth = map[string]string{"Authorization": "Bearer lsk_test"}
+)
+
+// mergeHeaders 合并多个来源的header
+func mergeHeaders(headers ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, header := range headers {
+		for name, value := range header {
+			merged[name] = value
+		}
+	}
+	return merged
+}
+
+// TestExtractCredentialsModes 测试每种来源单独使用时提取的登录信息
+func TestExtractCredentialsModes(t *testing.T) {
+	router := setupAuthRouter(t, config.AuthConfig{Modes: []string{config.AuthModeCookie, config.AuthModeHeader, config.AuthModeBearer}})
+
+	cases := []struct {
+		name   string
+		header map[string]string
+		want   credentialsResult
+	}{
+		{"cookie", cookieAuth, credentialsResult{Mode: config.AuthModeCookie, UserID: "u1", Token: "cookie-token", Present: true}},
+		{"header", headerAuth, credentialsResult{Mode: config.AuthModeHeader, UserID: "u2", Token: "header-token", Present: true}},
+		{"bearer", bearerAuth, credentialsResult{Mode: config.AuthModeBearer, Token: "lsk_test", Present: true}},
+		{"bearer不区分大小写", map[string]string{"Authorization": "bearer lsk_test"}, credentialsResult{Mode: config.AuthModeBearer, Token: "lsk_test", Present: true}},
+		{"Basic不是bearer", map[string]string{"Authorization": "Basic dTE6cGFzc3dvcmQ="}, credentialsResult{}},
+		{"空的bearer", map[string]string{"Authorization": "Bearer  "}, credentialsResult{}},
+		{"Cookie缺少token", map[string]string{"Cookie": "xuserid=u1"}, credentialsResult{}},
+		{"header缺少用户", map[string]string{"X-Token": "header-token"}, credentialsResult{}},
+		{"没有登录信息", nil, credentialsResult{}},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, extractCredentials(t, router, "/whoami", c.header), c.name)
+	}
+}
+
+// TestExtractCredentialsFallback 测试按 auth.modes 的顺序使用第一个完整的来源，未配置的来源被忽略
+func TestExtractCredentialsFallback(t *testing.T) {
+	all := mergeHeaders(cookieAuth, headerAuth, bearerAuth)
+
+	router := setupAuthRouter(t, config.AuthConfig{Modes: []string{config.AuthModeCookie, config.AuthModeHeader, config.AuthModeBearer}})
+	assert.Equal(t, config.AuthModeCookie, extractCredentials(t, router, "/whoami", all).Mode)
+	assert.Equal(t, config.AuthModeHeader, extractCredentials(t, router, "/whoami", mergeHeaders(headerAuth, bearerAuth)).Mode)
+	// 不完整的Cookie继续尝试下一个来源
+	incomplete := mergeHeaders(map[string]string{"Cookie": "xuserid=u1"}, headerAuth)
+	assert.Equal(t, config.AuthModeHeader, extractCredentials(t, router, "/whoami", incomplete).Mode)
+
+	router = setupAuthRouter(t, config.AuthConfig{Modes: []string{config.AuthModeBearer, config.AuthModeHeader}})
+	assert.Equal(t, config.AuthModeBearer, extractCredentials(t, router, "/whoami", all).Mode)
+	assert.Equal(t, config.AuthModeHeader, extractCredentials(t, router, "/whoami", mergeHeaders(cookieAuth, headerAuth)).Mode)
+	assert.False(t, extractCredentials(t, router, "/whoami", cookieAuth).Present)
+}
+
+// TestExtractCredentialsRouteOverride 测试 auth.routes 按注册的路由覆盖来源，其他路由使用 auth.modes
+func TestExtractCredentialsRouteOverride(t *testing.T) {
+	router := setupAuthRouter(t, config.AuthConfig{
+		Modes:  []string{config.AuthModeCookie, config.AuthModeHeader},
+		Routes: map[string][]string{"/items/:id": {config.AuthModeBearer}},
+	})
+
+	// 路由只接受API key
+	assert.False(t, extractCredentials(t, router, "/items/1", mergeHeaders(cookieAuth, headerAuth)).Present)
+	assert.Equal(t, config.AuthModeBearer, extractCredentials(t, router, "/items/1", mergeHeaders(cookieAuth, bearerAuth)).Mode)
+
+	// 其他路由不接受API key
+	assert.False(t, extractCredentials(t, router, "/whoami", bearerAuth).Present)
+	assert.Equal(t, config.AuthModeCookie, extractCredentials(t, router, "/whoami", mergeHeaders(cookieAuth, bearerAuth)).Mode)
+}
+
+// TestMissingCredentials 测试没有在允许的来源中找到登录信息时返回401，Basic认证不作为API key
+func TestMissingCredentials(t *testing.T) {
+	router := setupAuthRouter(t, config.AuthConfig{Modes: []string{config.AuthModeCookie, config.AuthModeHeader, config.AuthModeBearer}})
+
+	for _, header := range []map[string]string{
+		nil,
+		{"Authorization": "Basic dTE6cGFzc3dvcmQ="},
+		{"Cookie": "xuserid=u1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/quota", nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, header)
+		assert.Contains(t, w.Body.String(), "缺少登录信息")
+	}
+
+	// 找到API key但key无效时同样返回401
+	req := httptest.NewRequest(http.MethodGet, "/quota", nil)
+	req.Header.Set("Authorization", "Bearer lsk_unknown")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "API key无效")
+}
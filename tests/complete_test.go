@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/api"
+	"limit_service/config"
+	"limit_service/middleware"
+	"limit_service/tools"
+)
+
+// testServiceToken 测试使用的 service.token
+const testServiceToken = "0123456789abcdef0123456789abcdef"
+
+// serviceLimits 代理回调测试使用的限速配置，用户和车都有并发上限
+const serviceLimits = `{
+  "chatgpt": {"free": {"gpt-4o": "10/3h"}},
+  "car_limits": {"*": {"rpm": 60, "concurrency": 1}},
+  "user_concurrency": {"*": 2}
+}`
+
+// setupServiceRouter 创建开放了代理回调接口的路由，用户 u1 的token为 t1，车 c1 的标签为 mini
+func setupServiceRouter(t *testing.T) (*gin.Engine, *miniredis.Miniredis) {
+	mr := setupTestRedis(t)
+	require.NoError(t, tools.LoadStarLimit(writeLimitFile(t, serviceLimits)))
+	t.Cleanup(func() { tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")) })
+	cfg := config.GetConfig()
+	previous := cfg.Service.Token
+	cfg.Service.Token = testServiceToken
+	t.Cleanup(func() { cfg.Service.Token = previous })
+
+	mr.Set("star:xtoken_u1", "t1")
+	mr.Set("star:car_status:c1", `{"label": "mini"}`)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.ExtractCredentialsMiddleware(cfg.Auth))
+	api.SetupAuditRoutes(router)
+	return router, mr
+}
+
+// auditAsUser 以用户 u1 的身份在车 c1 上提问，返回审核结果
+func auditAsUser(t *testing.T, router *gin.Engine) api.AuditResponse {
+	body := `{"action": "next", "model": "gpt-4o", "messages": [{"content": {"parts": ["你好"]}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/audit", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User-Id", "u1")
+	req.Header.Set("X-Token", "t1")
+	req.Header.Set("carid", "c1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var response api.AuditResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotEmpty(t, response.LeaseID)
+	return response
+}
+
+// postComplete 调用请求完成回调，header 为附加的认证信息
+func postComplete(router *gin.Engine, leaseID, outcome string, header map[string]string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(api.CompleteRequest{LeaseID: leaseID, Outcome: outcome})
+	req := httptest.NewRequest(http.MethodPost, "/audit/complete", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestCompleteRequiresService 测试请求完成回调只接受代理的密钥，并按 /audit 保存的记录释放名额
+func TestCompleteRequiresService(t *testing.T) {
+	router, mr := setupServiceRouter(t)
+	response := auditAsUser(t, router)
+	inflight := func(key string) int {
+		members, _ := mr.ZMembers(key)
+		return len(members)
+	}
+	assert.Equal(t, 1, inflight("star:star_user_inflight:u1"))
+	assert.Equal(t, 1, inflight("star:car_inflight:c1"))
+
+	// 用户自己的登录信息和错误的密钥都不能释放名额
+	for _, header := range []map[string]string{
+		{"X-User-Id": "u1", "X-Token": "t1"},
+		{middleware.ServiceTokenHeader: "wrong"},
+	} {
+		w := postComplete(router, response.LeaseID, "success", header)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	assert.Equal(t, 1, inflight("star:star_user_inflight:u1"))
+	assert.Equal(t, 1, inflight("star:car_inflight:c1"))
+
+	// 代理完成后释放用户和车的名额，重复调用同样返回成功
+	service := map[string]string{middleware.ServiceTokenHeader: testServiceToken}
+	for i := 0; i < 2; i++ {
+		w := postComplete(router, response.LeaseID, "success", service)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assert.Equal(t, 0, inflight("star:star_user_inflight:u1"))
+	assert.Equal(t, 0, inflight("star:car_inflight:c1"))
+	assert.False(t, mr.Exists("star:star_lease:"+response.LeaseID))
+}
+
+// TestCarReportRequiresService 测试车上报只接受代理的密钥，并拒绝车目录中没有的车
+func TestCarReportRequiresService(t *testing.T) {
+	router, mr := setupServiceRouter(t)
+	report := func(carid string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, "/cars/"+carid+"/report", strings.NewReader(`{"outcome": "5xx"}`))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	service := map[string]string{middleware.ServiceTokenHeader: testServiceToken}
+
+	assert.Equal(t, http.StatusUnauthorized, report("c1", map[string]string{"X-User-Id": "u1", "X-Token": "t1"}))
+	assert.Equal(t, http.StatusNotFound, report("c404", service))
+	assert.False(t, mr.Exists("star:car_outcomes:c404"))
+
+	assert.Equal(t, http.StatusOK, report("c1", service))
+	assert.True(t, mr.Exists("star:car_outcomes:c1"))
+
+	// 车目录缓存之后新增的车不需要等到缓存过期
+	previous := tools.Cars
+	tools.Cars = tools.NewCarDirectory(time.Hour)
+	t.Cleanup(func() { tools.Cars = previous })
+	assert.Equal(t, http.StatusOK, report("c1", service))
+	mr.Set("star:car_status:c2", `{"label": "mini"}`)
+	assert.Equal(t, http.StatusOK, report("c2", service))
+	assert.Equal(t, http.StatusNotFound, report("c404", service))
+}
+
+// TestCompleteRefundRequiresService 测试用户不能通过完成回调退还自己的额度，代理上报失败时只退还一次
+func TestCompleteRefundRequiresService(t *testing.T) {
+	router, _ := setupServiceRouter(t)
+	used := func() float64 {
+		pkg, err := tools.Packages.Resolve("u1", "chatgpt")
+		require.NoError(t, err)
+		quota, err := tools.GetStarQuota(pkg, "gpt-4o")
+		require.NoError(t, err)
+		require.Len(t, quota, 1)
+		return quota[0].Used
+	}
+
+	response := auditAsUser(t, router)
+	require.NotEmpty(t, response.ReservationID)
+	assert.Equal(t, float64(1), used())
+
+	w := postComplete(router, response.LeaseID, "failure", map[string]string{"X-User-Id": "u1", "X-Token": "t1"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, float64(1), used())
+
+	service := map[string]string{middleware.ServiceTokenHeader: testServiceToken}
+	for i := 0; i < 2; i++ {
+		w = postComplete(router, response.LeaseID, "failure", service)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	assert.Equal(t, float64(0), used())
+
+	// 已经确认的预留不能再退还
+	response = auditAsUser(t, router)
+	confirmed, err := tools.ConfirmReservation("u1", response.ReservationID)
+	assert.NoError(t, err)
+	assert.True(t, confirmed)
+	refunded, err := tools.RefundReservation("u1", response.ReservationID)
+	assert.NoError(t, err)
+	assert.False(t, refunded)
+	assert.Equal(t, float64(1), used())
+}
+
+// TestConcurrencyRequiresService 测试未配置 service.token 时不占用用户和车的并发名额，车只限制请求频率
+func TestConcurrencyRequiresService(t *testing.T) {
+	router, mr := setupServiceRouter(t)
+	config.GetConfig().Service.Token = ""
+
+	// 用户的并发上限为2、车的并发上限为1，之后的请求仍然通过
+	for i := 0; i < 3; i++ {
+		auditAsUser(t, router)
+	}
+	assert.False(t, mr.Exists("star:star_user_inflight:u1"))
+	assert.False(t, mr.Exists("star:car_inflight:c1"))
+	members, err := mr.ZMembers("star:car_rpm:c1")
+	require.NoError(t, err)
+	assert.Len(t, members, 3)
+}
+
+// TestRefundReservationNewWindow 测试计数器在新窗口重新创建后，旧窗口的预留不会退还到新计数器上
+func TestRefundReservationNewWindow(t *testing.T) {
+	mr := setupTestRedis(t)
+	require.NoError(t, tools.LoadStarLimit(writeLimitFile(t, `{"chatgpt": {"free": {"gpt-4o": "10/1h"}}}`)))
+	t.Cleanup(func() { tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")) })
+
+	pkg := &tools.UserPackage{UserID: "u1", Product: "chatgpt", Level: "free"}
+	consume := func() string {
+		allowed, _, reservationID, err := tools.GetStarLimit(pkg, "gpt-4o", 0)
+		require.NoError(t, err)
+		require.True(t, allowed)
+		require.NotEmpty(t, reservationID)
+		return reservationID
+	}
+	old := consume()
+	var counterKey string
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, "rate_limit:u1:") {
+			counterKey = key
+		}
+	}
+	require.NotEmpty(t, counterKey)
+
+	// 旧窗口结束后计数器以相同的键重新创建，过期时间不同
+	mr.Del(counterKey)
+	current := consume()
+	mr.SetTTL(counterKey, 30*time.Minute)
+
+	refunded, err := tools.RefundReservation("u1", old)
+	require.NoError(t, err)
+	assert.True(t, refunded)
+	value, _ := mr.Get(counterKey)
+	assert.Equal(t, "1", value)
+
+	// 同一窗口的预留正常退还
+	mr.SetTTL(counterKey, time.Hour)
+	refunded, err = tools.RefundReservation("u1", current)
+	require.NoError(t, err)
+	assert.True(t, refunded)
+	value, _ = mr.Get(counterKey)
+	assert.Equal(t, "0", value)
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"limit_service/config"
+)
+
+// writeConfigFile 在临时目录写入配置文件
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("写入配置文件失败: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfigFile 测试从配置文件加载
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 8080
+  mode: release
+paths:
+  limit: /etc/limit/limit.json
+redis:
+  mode: sentinel
+  addrs: ["s1:26379", "s2:26379"]
+  master_name: mymaster
+  read_timeout: 500ms
+`)
+
+	cfg, err := config.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 8080, cfg.Server.Port)
+	assert.Equal(t, "release", cfg.Server.Mode)
+	assert.Equal(t, "/etc/limit/limit.json", cfg.Paths.Limit)
+	assert.Equal(t, "./data/keywords.txt", cfg.Paths.Keywords)
+	assert.Equal(t, []string{"s1:26379", "s2:26379"}, cfg.Redis.Addrs)
+	assert.Equal(t, 500*time.Millisecond, cfg.Redis.ReadTimeout)
+	assert.Equal(t, "star:", cfg.Keys.Prefix)
+}
+
+// TestLoadConfigEnvOverride 测试环境变量覆盖配置文件
+func TestLoadConfigEnvOverride(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  port: 8080\n")
+	t.Setenv("SERVER_PORT", "9090")
+	t.Setenv("REDIS_KEY_PREFIX", "staging:")
+
+	cfg, err := config.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 9090, cfg.Server.Port)
+	assert.Equal(t, "staging:", cfg.Keys.Prefix)
+}
+
+// TestLoadConfigInvalid 测试非法配置在加载时报错
+func TestLoadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  port: 8080\n")
+
+	t.Setenv("REDIS_PORT", "abc")
+	_, err := config.Load(path)
+	assert.ErrorContains(t, err, "REDIS_PORT")
+
+	t.Setenv("REDIS_PORT", "")
+	t.Setenv("REDIS_MODE", "cluster")
+	_, err = config.Load(path)
+	assert.ErrorContains(t, err, "redis.addrs")
+
+	t.Setenv("REDIS_MODE", "")
+	_, err = config.Load(writeConfigFile(t, "policies:\n  package_transition: keep\n"))
+	assert.ErrorContains(t, err, "policies.package_transition")
+	_, err = config.Load(writeConfigFile(t, "policies:\n  reservation_policy: drop\n"))
+	assert.ErrorContains(t, err, "policies.reservation_policy")
+	_, err = config.Load(writeConfigFile(t, "server:\n  trusted_proxies: [\"10.0.0.0/8\", \"proxy\"]\n"))
+	assert.ErrorContains(t, err, "server.trusted_proxies[1]")
+	_, err = config.Load(writeConfigFile(t, "ip_limit:\n  allowlist: [\"10.0.0.0/33\"]\n"))
+	assert.ErrorContains(t, err, "ip_limit.allowlist[0]")
+	_, err = config.Load(writeConfigFile(t, "auth:\n  hmac_secret: short\n"))
+	assert.ErrorContains(t, err, "auth.hmac_secret")
+	_, err = config.Load(writeConfigFile(t, "auth:\n  routes:\n    /quota: [token]\n"))
+	assert.ErrorContains(t, err, "auth.routes[/quota][0]")
+
+	// 未知字段视为配置错误
+	_, err = config.Load(writeConfigFile(t, "server:\n  prot: 8080\n"))
+	assert.Error(t, err)
+
+	// 显式指定的配置文件不存在
+	_, err = config.Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"limit_service/api"
+	"limit_service/config"
+	"limit_service/middleware"
+)
+
+// setupIPLimitRouter 使用给定的 ip_limit 配置创建路由，/ping 总是成功，/quota 需要登录
+func setupIPLimitRouter(t *testing.T, ipLimit config.IPLimitConfig) (*gin.Engine, *miniredis.Miniredis) {
+	mr := setupTestRedis(t)
+	cfg := config.GetConfig()
+	previous := cfg.IPLimit
+	cfg.IPLimit = ipLimit
+	t.Cleanup(func() { cfg.IPLimit = previous })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.IPLimitMiddleware(ipLimit))
+	router.Use(middleware.ExtractCredentialsMiddleware(cfg.Auth))
+	router.GET("/ping", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	api.SetupQuotaRoutes(router)
+	return router, mr
+}
+
+// requestFrom 从指定的客户端地址发送请求
+func requestFrom(router *gin.Engine, remoteAddr, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remoteAddr
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestIPLimitAllowlist 测试allowlist中的单个IP和CIDR网段不限速，其他IP正常限速
+func TestIPLimitAllowlist(t *testing.T) {
+	router, mr := setupIPLimitRouter(t, config.IPLimitConfig{
+		Requests:  1,
+		Window:    time.Minute,
+		Allowlist: []string{"10.0.0.0/8", "192.168.1.5", "2001:db8::/32"},
+	})
+
+	for _, addr := range []string{"10.1.2.3:1234", "10.255.0.1:1234", "192.168.1.5:1234", "[2001:db8::1]:1234"} {
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, http.StatusOK, requestFrom(router, addr, "/ping", nil).Code, addr)
+		}
+	}
+	assert.Empty(t, mr.Keys())
+
+	// 网段之外的IP正常限速
+	for _, addr := range []string{"192.168.1.6:1234", "11.0.0.1:1234", "[2001:db9::1]:1234"} {
+		assert.Equal(t, http.StatusOK, requestFrom(router, addr, "/ping", nil).Code, addr)
+		assert.Equal(t, http.StatusTooManyRequests, requestFrom(router, addr, "/ping", nil).Code, addr)
+	}
+}
+
+// TestIPLimitRequests 测试每个IP在窗口内的请求数上限，超过时返回 ip_rate 和 Retry-After
+func TestIPLimitRequests(t *testing.T) {
+	router, mr := setupIPLimitRouter(t, config.IPLimitConfig{Requests: 2, Window: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.4:1234", "/ping", nil).Code)
+	}
+	w := requestFrom(router, "1.2.3.4:1234", "/ping", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"ip_rate"`)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// 其他IP不受影响，窗口结束后恢复
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.5:1234", "/ping", nil).Code)
+	mr.FastForward(time.Minute)
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.4:1234", "/ping", nil).Code)
+}
+
+// TestIPLimitAuthFailureLockout 测试同一IP认证失败达到上限后被锁定，锁定期间正常的请求同样被拒绝
+func TestIPLimitAuthFailureLockout(t *testing.T) {
+	router, mr := setupIPLimitRouter(t, config.IPLimitConfig{
+		AuthFailures:      3,
+		AuthFailureWindow: 10 * time.Minute,
+		Lockout:           30 * time.Minute,
+	})
+	mr.Set("star:xtoken_u1", "t1")
+	stale := map[string]string{"X-User-Id": "u1", "X-Token": "stale"}
+	badKey := map[string]string{"Authorization": "Bearer lsk_unknown"}
+
+	// 登录信息过期不计入认证失败
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusTooManyRequests, requestFrom(router, "1.2.3.4:1234", "/quota", stale).Code)
+	}
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.4:1234", "/ping", nil).Code)
+
+	// 缺少登录信息和API key无效计入认证失败
+	assert.Equal(t, http.StatusUnauthorized, requestFrom(router, "1.2.3.4:1234", "/quota", nil).Code)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusUnauthorized, requestFrom(router, "1.2.3.4:1234", "/quota", badKey).Code)
+	}
+
+	w := requestFrom(router, "1.2.3.4:1234", "/ping", nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"ip_locked"`)
+	assert.Equal(t, "1800", w.Header().Get("Retry-After"))
+
+	// 其他IP不受影响，锁定结束后恢复
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.5:1234", "/ping", nil).Code)
+	mr.FastForward(30 * time.Minute)
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.4:1234", "/ping", nil).Code)
+}
+
+// TestIPLimitDisabledByDefault 测试默认配置不限制请求数，也不因认证失败锁定IP
+func TestIPLimitDisabledByDefault(t *testing.T) {
+	router, mr := setupIPLimitRouter(t, config.Default().IPLimit)
+
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, http.StatusUnauthorized, requestFrom(router, "1.2.3.4:1234", "/quota", nil).Code)
+	}
+	assert.Equal(t, http.StatusOK, requestFrom(router, "1.2.3.4:1234", "/ping", nil).Code)
+	assert.Empty(t, mr.Keys())
+}
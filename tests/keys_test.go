@@ -0,0 +1,39 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"limit_service/config"
+	"limit_service/tools"
+)
+
+// TestKeySchemaHashTags 测试只有集群模式才为键加上哈希标签
+func TestKeySchemaHashTags(t *testing.T) {
+	single, err := tools.NewKeySchema(config.Default().Keys, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "star_rate_limit:12345:base:gpt-4o", single.RateLimit("12345", "base", "gpt-4o"))
+	assert.Equal(t, "star_rate_limit_package:12345", single.RateLimitPackage("12345", ""))
+	assert.Equal(t, "car_rpm:c7", single.CarRPM("c7"))
+
+	cluster, err := tools.NewKeySchema(config.Default().Keys, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "star_rate_limit:{12345}:base:gpt-4o", cluster.RateLimit("12345", "base", "gpt-4o"))
+	assert.Equal(t, "star_rate_limit_index:{12345}", cluster.RateLimitIndex("12345"))
+	assert.Equal(t, "car_rpm:{c7}", cluster.CarRPM("c7"))
+
+	// 与主应用共享的键不加哈希标签
+	assert.Equal(t, "xtoken_12345", cluster.Token("12345"))
+}
+
+// TestKeySchemaVersion 测试版本号只插入到本服务自有的键，与主应用共享的键保持不变
+func TestKeySchemaVersion(t *testing.T) {
+	cfg := config.Default().Keys
+	cfg.Version = "v2"
+	schema, err := tools.NewKeySchema(cfg, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "star_rate_limit:12345:base:gpt-4o", schema.RateLimit("12345", "base", "gpt-4o"))
+	assert.Equal(t, "star_rate_limit_package:12345:claude", schema.RateLimitPackage("12345", "claude"))
+	assert.Equal(t, "user:12345:active_packages", schema.ActivePackages("12345"))
+	assert.Equal(t, "v2:star_rate_limit_index:12345", schema.RateLimitIndex("12345"))
+}
@@ -0,0 +1,327 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/tools"
+)
+
+// writeLimitFile 在临时目录写入限速配置文件
+func writeLimitFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "limit.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("写入限速配置文件失败: %v", err)
+	}
+	return path
+}
+
+// TestParseLimitRule 测试限速规则解析
+func TestParseLimitRule(t *testing.T) {
+	rule, err := tools.ParseLimitRule("15/3h")
+	assert.NoError(t, err)
+	assert.Equal(t, 15, rule.Count)
+	assert.Equal(t, 3*time.Hour, rule.Window)
+
+	rule, err = tools.ParseLimitRule("5/90")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, rule.Window)
+
+	rule, err = tools.ParseLimitRule("20/1h30m")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, rule.Window)
+	assert.Equal(t, "1小时30分钟", rule.WindowText())
+
+	rule, err = tools.ParseLimitRule("100/1mo")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rule.Months)
+	assert.Equal(t, "1个月", rule.WindowText())
+
+	rule, err = tools.ParseLimitRule("5/1w")
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, rule.Window)
+
+	rule, err = tools.ParseLimitRule("5/48h@UTC")
+	assert.NoError(t, err)
+	assert.True(t, rule.Aligned)
+	assert.Equal(t, 48*time.Hour, rule.Window)
+
+	invalid := []string{"15/3x", "15", "a/3h", "-1/3h", "5/0h", "5/1h1h", "5/h", "5/1h30m@UTC", "5/5h@UTC", "5/36h@UTC", "5/90000@UTC", "5/1d@Mars/Base"}
+	for _, limitStr := range invalid {
+		_, err := tools.ParseLimitRule(limitStr)
+		assert.Error(t, err, limitStr)
+	}
+}
+
+// TestLimitRuleAlignedPeriod 测试按日历边界对齐的窗口
+func TestLimitRuleAlignedPeriod(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip("缺少时区数据")
+	}
+	// 2024-08-07 是周三
+	now := time.Date(2024, 8, 7, 15, 20, 0, 0, shanghai)
+
+	daily, err := tools.ParseLimitRule("5/1d@Asia/Shanghai")
+	assert.NoError(t, err)
+	start, end := daily.Period(now)
+	assert.Equal(t, time.Date(2024, 8, 7, 0, 0, 0, 0, shanghai), start)
+	assert.Equal(t, time.Date(2024, 8, 8, 0, 0, 0, 0, shanghai), end)
+	assert.Equal(t, "20240807T0000", daily.Bucket(now))
+
+	hourly, _ := tools.ParseLimitRule("5/3h@Asia/Shanghai")
+	start, end = hourly.Period(now)
+	assert.Equal(t, time.Date(2024, 8, 7, 15, 0, 0, 0, shanghai), start)
+	assert.Equal(t, time.Date(2024, 8, 7, 18, 0, 0, 0, shanghai), end)
+
+	// 用小时或秒表示的整天数窗口按天对齐，不会每天重置
+	for _, limitStr := range []string{"5/48h@Asia/Shanghai", "5/172800@Asia/Shanghai", "5/2d@Asia/Shanghai"} {
+		twoDays, err := tools.ParseLimitRule(limitStr)
+		require.NoError(t, err, limitStr)
+		start, end = twoDays.Period(now)
+		assert.Equal(t, time.Date(2024, 8, 7, 0, 0, 0, 0, shanghai), start, limitStr)
+		assert.Equal(t, time.Date(2024, 8, 9, 0, 0, 0, 0, shanghai), end, limitStr)
+		start, _ = twoDays.Period(now.AddDate(0, 0, 1))
+		assert.Equal(t, time.Date(2024, 8, 7, 0, 0, 0, 0, shanghai), start, limitStr)
+	}
+
+	weekly, _ := tools.ParseLimitRule("5/1w@Asia/Shanghai")
+	start, end = weekly.Period(now)
+	assert.Equal(t, time.Date(2024, 8, 5, 0, 0, 0, 0, shanghai), start)
+	assert.Equal(t, time.Date(2024, 8, 12, 0, 0, 0, 0, shanghai), end)
+
+	monthly, _ := tools.ParseLimitRule("5/1mo@Asia/Shanghai")
+	start, end = monthly.Period(now)
+	assert.Equal(t, time.Date(2024, 8, 1, 0, 0, 0, 0, shanghai), start)
+	assert.Equal(t, time.Date(2024, 9, 1, 0, 0, 0, 0, shanghai), end)
+
+	// 非对齐窗口从当前时间开始
+	fixed, _ := tools.ParseLimitRule("5/1mo")
+	start, end = fixed.Period(now)
+	assert.Equal(t, now, start)
+	assert.Equal(t, now.AddDate(0, 1, 0), end)
+	assert.Equal(t, "", fixed.Bucket(now))
+}
+
+// TestLoadStarLimitValidation 测试加载时校验所有规则并报告路径
+func TestLoadStarLimitValidation(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "chatgpt": {
+    "base": {"gpt-4o": "15/3x", "gpt-4": "10/3h"},
+    "pro": {"o1-mini": "abc/168h"}
+  },
+  "other": "40/3h",
+  "user_concurrency": {"free": -1, "pro": 5},
+  "sharing": {"free": {"ips": 3, "action": "ban"}}
+}`)
+
+	err := tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "chatgpt.base.gpt-4o")
+	assert.ErrorContains(t, err, "chatgpt.pro.o1-mini")
+	assert.NotContains(t, err.Error(), "chatgpt.base.gpt-4:")
+	assert.ErrorContains(t, err, "user_concurrency.free")
+	assert.NotContains(t, err.Error(), "user_concurrency.pro")
+	assert.ErrorContains(t, err, "sharing.free.action")
+
+	// 合法配置可以正常加载
+	assert.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+}
+
+// TestLoadStarLimitCarAccess 测试车权限矩阵的校验
+func TestLoadStarLimitCarAccess(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "other": "40/3h",
+  "car_access": {
+    "levels": {"free": {"allow": ["mini", "[bad"]}, "pro": null},
+    "users": {"12345": {"deny": ["car-*"]}}
+  }
+}`)
+
+	err := tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "car_access.levels.free.allow[1]")
+	assert.ErrorContains(t, err, "car_access.levels.pro")
+	assert.NotContains(t, err.Error(), "car_access.users")
+
+	assert.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+}
+
+// TestResolveLimitRule 测试别名、通配模式和other的匹配优先级
+func TestResolveLimitRule(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "chatgpt": {
+    "base": {
+      "gpt-4o": "15/3h",
+      "gpt-4o-mini": "100/3h",
+      "gpt-4o*": "10/3h",
+      "gpt-*": "5/3h",
+      "o1-*": "2/168h",
+      "other": "20/3h"
+    }
+  },
+  "aliases": {"chatgpt-4o-latest": "gpt-4o"},
+  "other": "40/3h"
+}`)
+	assert.NoError(t, tools.LoadStarLimit(path))
+
+	cases := []struct {
+		packageType, model, matchedBy, ruleKey string
+	}{
+		{"base", "gpt-4o", tools.MatchExact, "gpt-4o"},
+		{"base", "gpt-4o-mini", tools.MatchExact, "gpt-4o-mini"},
+		{"base", "chatgpt-4o-latest", tools.MatchExact, "gpt-4o"},
+		{"base", "gpt-4o-2024-08-06", tools.MatchPattern, "gpt-4o*"},
+		{"base", "gpt-4-turbo", tools.MatchPattern, "gpt-*"},
+		{"base", "o1-preview-xyz", tools.MatchPattern, "o1-*"},
+		{"base", "claude-3", tools.MatchPackageOther, "other"},
+		{"unknown", "gpt-4o", tools.MatchOther, "other"},
+	}
+	for _, c := range cases {
+		resolved := tools.ResolveLimitRule("chatgpt", c.packageType, c.model)
+		if assert.NotNil(t, resolved, c.model) {
+			assert.Equal(t, c.matchedBy, resolved.MatchedBy, c.model)
+			assert.Equal(t, c.ruleKey, resolved.RuleKey, c.model)
+		}
+	}
+
+	// 链式别名和非法通配模式在加载时报错
+	path = writeLimitFile(t, `{
+  "chatgpt": {"base": {"gpt-[4o": "15/3h"}},
+  "aliases": {"a": "b", "b": "gpt-4o"}
+}`)
+	err := tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "chatgpt.base.gpt-[4o")
+	assert.ErrorContains(t, err, "aliases.a")
+}
+
+// TestLoadStarLimitGroups 测试共享额度组的校验
+func TestLoadStarLimitGroups(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "chatgpt": {"base": {"group:gpt-4o": "15/3h", "group:missing": "5/3h"}},
+  "groups": {"gpt-4o": ["gpt-4o", "gpt-4o-canmore"], "dup": ["gpt-4o"]}
+}`)
+	err := tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "chatgpt.base.group:missing")
+	assert.ErrorContains(t, err, "groups.gpt-4o")
+}
+
+// TestLoadStarLimitWeights 测试积分权重的校验
+func TestLoadStarLimitWeights(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "chatgpt": {"pro": {"credits": "1000/1d", "credits-x": "5/1h"}},
+  "weights": {"o1-*": 20, "gpt-4o-mini": 0.2, "bad": -1}
+}`)
+	err := tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "weights.bad")
+	assert.NotContains(t, err.Error(), "credits")
+}
+
+// TestParseRuleList 测试按token计量和多条规则组合
+func TestParseRuleList(t *testing.T) {
+	rules, err := tools.ParseRuleList("15/3h, 100000tok/1d")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+	assert.Equal(t, tools.UnitMessage, rules[0].Unit)
+	assert.Equal(t, tools.UnitToken, rules[1].Unit)
+	assert.Equal(t, 100000, rules[1].Count)
+	assert.Equal(t, "15/3h, 100000tok/1d", rules.String())
+
+	invalid := []string{"15/3h, 20/1d", "5tok/1h,6tok/1d", "15/3h,", "5tk/1h"}
+	for _, value := range invalid {
+		_, err := tools.ParseRuleList(value)
+		assert.Error(t, err, value)
+	}
+}
+
+// TestEstimateTokens 测试提问token数估算
+func TestEstimateTokens(t *testing.T) {
+	assert.Equal(t, 0, tools.EstimateTokens(""))
+	assert.Equal(t, 4, tools.EstimateTokens("你好世界"))
+	assert.Equal(t, 2, tools.EstimateTokens("hello"))
+	assert.Equal(t, 12, tools.EstimateTokens("Hello, world! 你好世界 12345"))
+}
+
+// TestLimitOverrideValidate 测试用户限速覆盖的校验和倍率缩放
+func TestLimitOverrideValidate(t *testing.T) {
+	rules, err := tools.ParseRuleList("15/3h, 100000tok/1d@")
+	assert.NoError(t, err)
+	scaled := rules.Scale(2)
+	assert.Equal(t, "30/3h, 200000tok/1d@", scaled.String())
+	assert.Equal(t, 15, rules[0].Count)
+
+	valid := []tools.LimitOverride{
+		{Key: "gpt-4o", Multiplier: 0.5},
+		{Key: "o1-*", Rule: "5/1d"},
+		{Key: "credits", Rule: "2000/1d"},
+		{Key: tools.OverrideAll, Multiplier: 2},
+	}
+	for _, override := range valid {
+		assert.NoError(t, override.Validate(), override.Key)
+	}
+
+	invalid := []tools.LimitOverride{
+		{Key: "", Multiplier: 2},
+		{Key: "gpt-4o"},
+		{Key: "gpt-4o", Rule: "5/1d", Multiplier: 2},
+		{Key: "gpt-4o", Multiplier: -1},
+		{Key: "gpt-4o", Rule: "5/1x"},
+		{Key: "credits", Rule: "1000tok/1d"},
+		{Key: tools.OverrideAll, Rule: "5/1d"},
+	}
+	for _, override := range invalid {
+		assert.Error(t, override.Validate(), override.Key)
+	}
+}
+
+// TestResolveProduct 测试多产品配置和产品选择
+func TestResolveProduct(t *testing.T) {
+	path := writeLimitFile(t, `{
+  "products": {
+    "claude": {"package_key": "Claude", "model_prefixes": ["claude-"], "packages": {"base": {"claude-3-opus*": "5/3h"}}},
+    "gemini": {"model_prefixes": ["gemini-"], "packages": {"Base": {"other": "10/3h"}}}
+  },
+  "chatgpt": {"base": {"gpt-4o": "15/3h"}}
+}`)
+	assert.NoError(t, tools.LoadStarLimit(path))
+	defer tools.LoadStarLimit("../data/limit.json")
+
+	cases := []struct {
+		requested, model, product string
+	}{
+		{"", "claude-3-opus-20240229", "claude"},
+		{"", "gemini-1.5-pro", "gemini"},
+		{"", "gpt-4o", "chatgpt"},
+		{"Claude", "gpt-4o", "claude"},
+	}
+	for _, c := range cases {
+		product, err := tools.ResolveProduct(c.requested, c.model)
+		assert.NoError(t, err, c.model)
+		assert.Equal(t, c.product, product, c.model)
+	}
+	_, err := tools.ResolveProduct("unknown", "gpt-4o")
+	assert.Error(t, err)
+
+	resolved := tools.ResolveLimitRule("claude", "base", "claude-3-opus-20240229")
+	if assert.NotNil(t, resolved) {
+		assert.Equal(t, "claude-3-opus*", resolved.RuleKey)
+	}
+	assert.Equal(t, tools.MatchPackageOther, tools.ResolveLimitRule("gemini", "base", "gemini-1.5-pro").MatchedBy)
+	assert.Nil(t, tools.ResolveLimitRule("claude", "base", "gpt-4o"))
+
+	// 新旧格式重复定义chatgpt、前缀重复时报错
+	path = writeLimitFile(t, `{
+  "products": {
+    "chatgpt": {"packages": {}},
+    "claude": {"model_prefixes": ["claude-"], "packages": {"base": {"x": "1/1x"}}},
+    "anthropic": {"model_prefixes": ["claude-"]}
+  },
+  "chatgpt": {"base": {"gpt-4o": "15/3h"}}
+}`)
+	err = tools.LoadStarLimit(path)
+	assert.ErrorContains(t, err, "chatgpt: ")
+	assert.ErrorContains(t, err, "products.claude.model_prefixes")
+	assert.ErrorContains(t, err, "products.claude.packages.base.x")
+}
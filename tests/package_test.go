@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"limit_service/config"
+	"limit_service/tools"
+)
+
+// TestResolvePackage 测试套餐过期时间的各种格式以及过期后回落到默认等级
+func TestResolvePackage(t *testing.T) {
+	mr := setupTestRedis(t)
+	assert.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+	resolver := tools.NewPackageResolver(0)
+
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	cases := []struct {
+		expiresAt string
+		level     string
+		expired   bool
+	}{
+		{`null`, "base", false},
+		{fmt.Sprintf(`%d`, future.Unix()), "base", false},
+		{fmt.Sprintf(`%d`, future.UnixMilli()), "base", false},
+		{fmt.Sprintf(`"%d"`, past.Unix()), "free", true},
+		{fmt.Sprintf(`%q`, future.Format(time.RFC3339)), "base", false},
+		{fmt.Sprintf(`%q`, past.Format(time.RFC3339)), "free", true},
+		{fmt.Sprintf(`%q`, past.Local().Format(time.DateTime)), "free", true},
+	}
+	for _, c := range cases {
+		mr.Set("star:user:u1:active_packages", fmt.Sprintf(`{"ChatGPT": {"level": "Base", "expires_at": %s}}`, c.expiresAt))
+		pkg, err := resolver.Resolve("u1", "chatgpt")
+		if assert.NoError(t, err, c.expiresAt) {
+			assert.Equal(t, c.level, pkg.Level, c.expiresAt)
+			assert.Equal(t, "base", pkg.ActiveLevel, c.expiresAt)
+			assert.Equal(t, c.expired, pkg.Expired, c.expiresAt)
+		}
+	}
+
+	// 没有激活套餐时使用默认等级
+	pkg, err := resolver.Resolve("u2", "chatgpt")
+	assert.NoError(t, err)
+	assert.Equal(t, "free", pkg.Level)
+
+	// 套餐数据格式错误时按默认等级处理并给出原因
+	for _, data := range []string{
+		`{"ChatGPT": {"level": "base", "expires_at": "next week"}}`,
+		`{"ChatGPT": {"level": 3}}`,
+		`{"ChatGPT": "base"}`,
+		`["base"]`,
+	} {
+		mr.Set("star:user:u1:active_packages", data)
+		pkg, err = resolver.Resolve("u1", "chatgpt")
+		if assert.NoError(t, err, data) {
+			assert.Equal(t, "free", pkg.Level, data)
+			assert.Contains(t, pkg.Fallback, "用户套餐数据格式错误", data)
+		}
+	}
+
+	// 未知的等级按默认等级处理，只在套餐未过期时给出原因
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": "ultra"}}`)
+	pkg, err = resolver.Resolve("u1", "chatgpt")
+	assert.NoError(t, err)
+	assert.Equal(t, "free", pkg.Level)
+	assert.Equal(t, "ultra", pkg.ActiveLevel)
+	assert.Contains(t, pkg.Fallback, "ultra")
+	mr.Set("star:user:u1:active_packages", fmt.Sprintf(`{"ChatGPT": {"level": "ultra", "expires_at": %d}}`, past.Unix()))
+	pkg, err = resolver.Resolve("u1", "chatgpt")
+	assert.NoError(t, err)
+	assert.Equal(t, "free", pkg.Level)
+	assert.Empty(t, pkg.Fallback)
+}
+
+// TestResolvePackageDenyUnknownLevel 测试开启 deny_unknown_level 后未知的等级返回 ErrUnknownLevel
+func TestResolvePackageDenyUnknownLevel(t *testing.T) {
+	mr := setupTestRedis(t)
+	assert.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+	cfg := config.GetConfig()
+	previous := cfg.Policies.DenyUnknownLevel
+	cfg.Policies.DenyUnknownLevel = true
+	t.Cleanup(func() { cfg.Policies.DenyUnknownLevel = previous })
+	resolver := tools.NewPackageResolver(0)
+
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": "ultra"}}`)
+	_, err := resolver.Resolve("u1", "chatgpt")
+	assert.ErrorIs(t, err, tools.ErrUnknownLevel)
+
+	// 格式错误的数据仍然按默认等级处理
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": 3}}`)
+	pkg, err := resolver.Resolve("u1", "chatgpt")
+	assert.NoError(t, err)
+	assert.Equal(t, "free", pkg.Level)
+}
+
+// TestPackageResolverCache 测试缓存时间内不重新读取Redis，Invalidate后立即读取
+func TestPackageResolverCache(t *testing.T) {
+	mr := setupTestRedis(t)
+	assert.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+	resolver := tools.NewPackageResolver(50 * time.Millisecond)
+
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": "base"}}`)
+	pkg, err := resolver.Resolve("u1", "chatgpt")
+	assert.NoError(t, err)
+	assert.Equal(t, "base", pkg.Level)
+
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": "pro"}}`)
+	pkg, _ = resolver.Resolve("u1", "chatgpt")
+	assert.Equal(t, "base", pkg.Level)
+
+	time.Sleep(60 * time.Millisecond)
+	pkg, _ = resolver.Resolve("u1", "chatgpt")
+	assert.Equal(t, "pro", pkg.Level)
+
+	mr.Set("star:user:u1:active_packages", `{"ChatGPT": {"level": "base"}}`)
+	resolver.Invalidate("u1")
+	pkg, _ = resolver.Resolve("u1", "chatgpt")
+	assert.Equal(t, "base", pkg.Level)
+}
@@ -0,0 +1,18 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"limit_service/tools"
+)
+
+// setupTestRedis 使用内存中的Redis替换全局Redis连接，测试结束后恢复
+func setupTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	previous := tools.RedisClient
+	tools.RedisClient = tools.NewRedisTool(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "star:")
+	t.Cleanup(func() { tools.RedisClient = previous })
+	return mr
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/config"
+	"limit_service/tools"
+)
+
+// testHMACSecret 测试使用的 auth.hmac_secret
+const testHMACSecret = "abcdefghijklmnopqrstuvwxyz012345"
+
+// useHMACSecret 在测试期间使用给定的签名密钥
+func useHMACSecret(t *testing.T, secret string) {
+	cfg := config.GetConfig()
+	previous := cfg.Auth.HMACSecret
+	cfg.Auth.HMACSecret = secret
+	t.Cleanup(func() { cfg.Auth.HMACSecret = previous })
+}
+
+// encodeSegment 把JSON编码为token的一段
+func encodeSegment(data string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(data))
+}
+
+// signSegments 用密钥对已经编码的各段签名，返回完整的token
+func signSegments(secret string, segments string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(segments))
+	return segments + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signJWT 按给定的头和声明签发JWT
+func signJWT(secret, header, claims string) string {
+	return signSegments(secret, encodeSegment(header)+"."+encodeSegment(claims))
+}
+
+// TestVerifySignedToken 测试签名token的签名、算法、有效期和用户校验
+func TestVerifySignedToken(t *testing.T) {
+	setupTestRedis(t)
+	useHMACSecret(t, testHMACSecret)
+
+	now := time.Now()
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	claims := func(sub string, exp, nbf time.Time) string {
+		return fmt.Sprintf(`{"sub":%q,"exp":%d,"nbf":%d}`, sub, exp.Unix(), nbf.Unix())
+	}
+	valid := claims("u1", now.Add(time.Hour), now.Add(-time.Minute))
+	issued, _, err := tools.IssueSignedToken("u1")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"服务签发的JWT", issued, true},
+		{"JWT", signJWT(testHMACSecret, hs256, valid), true},
+		{"HMAC签名token", signSegments(testHMACSecret, encodeSegment(valid)), true},
+		{"签名错误", signJWT("another-secret-another-secret-000", hs256, valid), false},
+		{"签名被截断", signJWT(testHMACSecret, hs256, valid) + "x", false},
+		{"alg为none", encodeSegment(`{"alg":"none","typ":"JWT"}`) + "." + encodeSegment(valid) + ".", false},
+		{"alg为HS512", signJWT(testHMACSecret, `{"alg":"HS512","typ":"JWT"}`, valid), false},
+		{"已过期", signJWT(testHMACSecret, hs256, claims("u1", now.Add(-time.Second), now.Add(-time.Hour))), false},
+		{"尚未生效", signJWT(testHMACSecret, hs256, claims("u1", now.Add(time.Hour), now.Add(time.Minute))), false},
+		{"用户不一致", signJWT(testHMACSecret, hs256, claims("u2", now.Add(time.Hour), now.Add(-time.Minute))), false},
+		{"头不是base64", signSegments(testHMACSecret, "!!!."+encodeSegment(valid)), false},
+		{"声明不是base64", signSegments(testHMACSecret, encodeSegment(hs256)+".!!!"), false},
+		{"声明不是JSON", signSegments(testHMACSecret, encodeSegment(hs256)+"."+encodeSegment("u1")), false},
+	}
+	for _, c := range cases {
+		ok, err := tools.VerifyTokenNoHeader("u1", c.token)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.valid, ok, c.name)
+	}
+
+	// 更换密钥后所有签名token失效
+	useHMACSecret(t, "0123456789012345678901234567890123")
+	ok, err := tools.VerifyTokenNoHeader("u1", issued)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// TestVerifySessionToken 测试会话token和旧的单一token在吊销后失效
+func TestVerifySessionToken(t *testing.T) {
+	mr := setupTestRedis(t)
+	mr.Set("star:xtoken_u1", "legacy")
+
+	session, _, err := tools.CreateSession("u1")
+	require.NoError(t, err)
+	for _, token := range []string{"legacy", session} {
+		ok, err := tools.VerifyTokenNoHeader("u1", token)
+		assert.NoError(t, err)
+		assert.True(t, ok, token)
+	}
+
+	// 其他用户不能使用该会话
+	ok, err := tools.VerifyTokenNoHeader("u2", session)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, tools.RevokeSessions("u1"))
+	for _, token := range []string{"legacy", session} {
+		ok, err := tools.VerifyTokenNoHeader("u1", token)
+		assert.NoError(t, err)
+		assert.False(t, ok, token)
+	}
+}
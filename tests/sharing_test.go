@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/tools"
+)
+
+// TestCheckSharing 测试账号共享检测的IP和设备上限，以及 flag 和 block 两种处理方式
+func TestCheckSharing(t *testing.T) {
+	setupTestRedis(t)
+	require.NoError(t, tools.LoadStarLimit(writeLimitFile(t, `{
+  "chatgpt": {"free": {}, "base": {}},
+  "sharing": {
+    "free": {"ips": 3, "devices": 2, "action": "block"},
+    "*": {"ips": 10, "devices": 5}
+  }
+}`)))
+	t.Cleanup(func() { tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")) })
+
+	// free 等级: 3个IP、2个设备，超过时拒绝
+	free := &tools.UserPackage{UserID: "u1", Product: "chatgpt", Level: "free"}
+	for i := 1; i <= 3; i++ {
+		signal, err := tools.CheckSharing(free, fmt.Sprintf("10.0.0.%d", i), "ua-1")
+		require.NoError(t, err)
+		assert.False(t, signal.Exceeded, "第%d个IP", i)
+		assert.False(t, signal.Blocked())
+	}
+	signal, err := tools.CheckSharing(free, "10.0.0.4", "ua-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), signal.IPs)
+	assert.True(t, signal.Exceeded)
+	assert.Equal(t, tools.SharingBlock, signal.Action)
+	assert.True(t, signal.Blocked())
+
+	devices := &tools.UserPackage{UserID: "u2", Product: "chatgpt", Level: "free"}
+	for i, expected := range []bool{false, false, true} {
+		signal, err := tools.CheckSharing(devices, "10.0.0.1", fmt.Sprintf("ua-%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, expected, signal.Exceeded, "第%d个设备", i+1)
+	}
+
+	// 其他等级使用 "*" 的上限: 10个IP，未配置处理方式时只记录
+	base := &tools.UserPackage{UserID: "u3", Product: "chatgpt", Level: "base"}
+	for i := 1; i <= 11; i++ {
+		signal, err = tools.CheckSharing(base, fmt.Sprintf("10.0.1.%d", i), "ua-1")
+		require.NoError(t, err)
+	}
+	assert.True(t, signal.Exceeded)
+	assert.Equal(t, tools.SharingFlag, signal.Action)
+	assert.False(t, signal.Blocked())
+
+	// 超过上限的请求写入用户的账号共享记录，最新的在前
+	report, err := tools.GetSharingReport("u1")
+	require.NoError(t, err)
+	if assert.Len(t, report.Detections, 1) {
+		detection := report.Detections[0]
+		assert.Equal(t, "10.0.0.4", detection.ClientIP)
+		assert.Equal(t, "free", detection.Level)
+		assert.Equal(t, int64(4), detection.IPs)
+		assert.Equal(t, tools.SharingBlock, detection.Action)
+	}
+	report, err = tools.GetSharingReport("u3")
+	require.NoError(t, err)
+	if assert.Len(t, report.Detections, 1) {
+		assert.Equal(t, tools.SharingFlag, report.Detections[0].Action)
+	}
+}
+
+// TestCheckSharingShippedConfig 测试自带的配置超过上限时只记录，不拒绝请求
+func TestCheckSharingShippedConfig(t *testing.T) {
+	setupTestRedis(t)
+	require.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+
+	for _, level := range []string{"free", "mini", "base", "pro"} {
+		pkg := &tools.UserPackage{UserID: "u-" + level, Product: "chatgpt", Level: level}
+		var signal *tools.SharingSignal
+		for i := 1; i <= 20; i++ {
+			var err error
+			signal, err = tools.CheckSharing(pkg, fmt.Sprintf("10.0.0.%d", i), "ua-1")
+			require.NoError(t, err)
+		}
+		assert.True(t, signal.Exceeded, level)
+		assert.Equal(t, tools.SharingFlag, signal.Action, level)
+		assert.False(t, signal.Blocked(), level)
+	}
+}
+
+// TestCheckSharingLongUserAgent 测试过长的User-Agent按字符截断，不会拆分多字节字符
+func TestCheckSharingLongUserAgent(t *testing.T) {
+	setupTestRedis(t)
+	require.NoError(t, tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")))
+
+	pkg := &tools.UserPackage{UserID: "u1", Product: "chatgpt", Level: "free"}
+	_, err := tools.CheckSharing(pkg, "10.0.0.1", "a"+strings.Repeat("设备", 100))
+	require.NoError(t, err)
+
+	report, err := tools.GetSharingReport("u1")
+	require.NoError(t, err)
+	require.Len(t, report.Devices, 1)
+	device := report.Devices[0].Value
+	assert.True(t, utf8.ValidString(device))
+	assert.LessOrEqual(t, len(device), 256)
+	assert.Equal(t, "a"+strings.Repeat("设备", 42)+"设", device)
+}
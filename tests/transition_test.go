@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"limit_service/config"
+	"limit_service/tools"
+)
+
+// TestPackageTransition 测试套餐变化时各迁移策略下计数器的初始值
+func TestPackageTransition(t *testing.T) {
+	setupTestRedis(t)
+	path := writeLimitFile(t, `{
+  "chatgpt": {
+    "free": {"gpt-4o": "4/3h"},
+    "base": {"gpt-4o": "10/3h"},
+    "pro": {"gpt-4o": "40/3h"}
+  }
+}`)
+	assert.NoError(t, tools.LoadStarLimit(path))
+	defer tools.LoadStarLimit(filepath.Join("..", "data", "limit.json"))
+
+	cfg := config.GetConfig()
+	previous := cfg.Policies.PackageTransition
+	defer func() { cfg.Policies.PackageTransition = previous }()
+
+	cases := []struct {
+		policy string
+		level  string
+		used   float64 // 迁移后的使用量，不包括迁移后这一次请求
+	}{
+		{config.TransitionReset, "pro", 0},
+		{config.TransitionCarry, "pro", 5},
+		{config.TransitionScale, "pro", 20}, // 5/10 升级到 40 为 20/40
+		{config.TransitionCarry, "free", 4}, // 降级后不超过新套餐的上限
+		{config.TransitionScale, "free", 2}, // 5/10 降级到 4 为 2/4
+	}
+	for i, c := range cases {
+		cfg.Policies.PackageTransition = c.policy
+		name := fmt.Sprintf("%s->%s", c.policy, c.level)
+		xuserid := fmt.Sprintf("transition-%d", i)
+
+		base := &tools.UserPackage{UserID: xuserid, Product: "chatgpt", Level: "base"}
+		for n := 0; n < 5; n++ {
+			allowed, _, _, err := tools.GetStarLimit(base, "gpt-4o", 0)
+			assert.True(t, allowed, name)
+			assert.NoError(t, err, name)
+		}
+
+		changed := &tools.UserPackage{UserID: xuserid, Product: "chatgpt", Level: c.level}
+		allowed, _, _, err := tools.GetStarLimit(changed, "gpt-4o", 0)
+		assert.NoError(t, err, name)
+		quotas, err := tools.GetStarQuota(changed, "gpt-4o")
+		if assert.NoError(t, err, name) && assert.Len(t, quotas, 1, name) {
+			if allowed {
+				assert.Equal(t, c.used+1, quotas[0].Used, name)
+			} else {
+				// 迁移后已经用完，本次请求被拒绝
+				assert.Equal(t, c.used, quotas[0].Used, name)
+				assert.Equal(t, quotas[0].Limit, quotas[0].Used, name)
+			}
+		}
+	}
+}
+
+// TestPackageTransitionWithoutIndex 测试索引中没有旧套餐的计数器时（如索引上线之前创建的计数器）按旧套餐的规则迁移并删除旧计数器
+func TestPackageTransitionWithoutIndex(t *testing.T) {
+	mr := setupTestRedis(t)
+	path := writeLimitFile(t, `{
+  "chatgpt": {
+    "base": {"gpt-4o": "10/3h", "o1*": "5/1d@UTC", "group:mini": "20/3h"},
+    "pro": {"gpt-4o": "40/3h", "o1*": "20/1d@UTC", "group:mini": "80/3h"}
+  },
+  "groups": {"mini": ["gpt-4o-mini"]}
+}`)
+	require.NoError(t, tools.LoadStarLimit(path))
+	t.Cleanup(func() { tools.LoadStarLimit(filepath.Join("..", "data", "limit.json")) })
+
+	cfg := config.GetConfig()
+	previous := cfg.Policies.PackageTransition
+	cfg.Policies.PackageTransition = config.TransitionCarry
+	t.Cleanup(func() { cfg.Policies.PackageTransition = previous })
+
+	base := &tools.UserPackage{UserID: "u1", Product: "chatgpt", Level: "base"}
+	for _, model := range []string{"gpt-4o", "gpt-4o", "o1-mini", "gpt-4o-mini"} {
+		allowed, _, _, err := tools.GetStarLimit(base, model, 0)
+		require.NoError(t, err)
+		require.True(t, allowed, model)
+	}
+	var oldKeys []string
+	for _, key := range mr.Keys() {
+		if strings.Contains(key, "rate_limit_index") {
+			mr.Del(key)
+		} else if strings.Contains(key, ":base:") {
+			oldKeys = append(oldKeys, key)
+		}
+	}
+	require.Len(t, oldKeys, 3)
+
+	pro := &tools.UserPackage{UserID: "u1", Product: "chatgpt", Level: "pro"}
+	allowed, _, _, err := tools.GetStarLimit(pro, "gpt-4o", 0)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	for model, used := range map[string]float64{"gpt-4o": 3, "o1-mini": 1, "gpt-4o-mini": 1} {
+		quotas, err := tools.GetStarQuota(pro, model)
+		require.NoError(t, err)
+		require.Len(t, quotas, 1, model)
+		assert.Equal(t, used, quotas[0].Used, model)
+	}
+	for _, key := range oldKeys {
+		assert.False(t, mr.Exists(key), key)
+	}
+}
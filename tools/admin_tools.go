@@ -0,0 +1,281 @@
+package tools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCounterNotFound 没有与请求匹配的计数器
+var ErrCounterNotFound = errors.New("没有匹配的计数器")
+
+// adminAuditLogSize 审计日志在Redis中保留的条数
+const adminAuditLogSize = 1000
+
+// CounterInfo 管理接口展示的用户计数器
+type CounterInfo struct {
+	Key     string     `json:"key"`
+	Product string     `json:"product"`
+	Package string     `json:"package"`
+	Name    string     `json:"name"` // 计数器键中的名称：模型名、通配模式、group:组名 或 credits
+	Unit    string     `json:"unit"`
+	Used    float64    `json:"used"`
+	Limit   float64    `json:"limit"`              // 计数器最近一次使用时的上限
+	TTL     int64      `json:"ttl"`                // 剩余秒数
+	ResetAt *time.Time `json:"reset_at,omitempty"` // 计数器过期时间
+}
+
+// AdminAuditEntry 一条管理操作审计记录
+type AdminAuditEntry struct {
+	Time     time.Time `json:"time"`
+	Admin    string    `json:"admin"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	UserID   string    `json:"user_id,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Status   int       `json:"status"`
+	ClientIP string    `json:"client_ip"`
+}
+
+// RecordAdminAudit 记录管理操作：输出到日志，并写入Redis中保留最近 adminAuditLogSize 条的审计列表
+func RecordAdminAudit(entry AdminAuditEntry) error {
+	fmt.Printf("[管理操作] %s 管理员=%s 用户=%s %s %s 状态=%d 来源=%s %s\n",
+		entry.Time.Format(time.DateTime), entry.Admin, entry.UserID, entry.Method, entry.Path, entry.Status, entry.ClientIP, entry.Detail)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("序列化审计记录失败: %w", err)
+	}
+	key := keys.AdminAudit()
+	if err := RedisClient.LPush(key, string(data)); err != nil {
+		return fmt.Errorf("写入审计记录失败: %w", err)
+	}
+	if err := RedisClient.LTrim(key, 0, adminAuditLogSize-1); err != nil {
+		return fmt.Errorf("裁剪审计记录失败: %w", err)
+	}
+	return nil
+}
+
+// GetAdminAudit 返回最近的管理操作审计记录，最新的在前
+func GetAdminAudit(limit int) ([]AdminAuditEntry, error) {
+	if limit <= 0 || limit > adminAuditLogSize {
+		limit = adminAuditLogSize
+	}
+	values, err := RedisClient.LRange(keys.AdminAudit(), 0, int64(limit-1))
+	if err != nil {
+		return nil, fmt.Errorf("获取审计记录失败: %w", err)
+	}
+	entries := make([]AdminAuditEntry, 0, len(values))
+	for _, value := range values {
+		var entry AdminAuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			fmt.Printf("审计记录格式错误，已忽略: %v\n", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// matchesCounter 判断索引中的计数器是否对应请求的名称，名称可以是计数器名称、模型名或模型别名
+func (e counterIndexEntry) matchesCounter(name string) bool {
+	if name == "" || e.Name == name || e.Name == canonicalModel(name) {
+		return true
+	}
+	resolved := getLimitRules(e.Product, e.Package, name, nil)
+	return resolved != nil && resolved.counterName() == e.Name
+}
+
+// counterInfo 读取单个计数器的使用情况，计数器不存在时返回false
+func counterInfo(key string, entry counterIndexEntry, now time.Time) (CounterInfo, bool, error) {
+	used, err := RedisClient.GetInt(key)
+	if err == redis.Nil {
+		return CounterInfo{}, false, nil
+	}
+	if err != nil {
+		return CounterInfo{}, false, fmt.Errorf("获取当前计数失败: %w", err)
+	}
+	ttl, err := RedisClient.TTL(key)
+	if err != nil {
+		return CounterInfo{}, false, fmt.Errorf("获取计数器过期时间失败: %w", err)
+	}
+
+	scale := float64(1)
+	if entry.Unit == UnitCredit {
+		scale = creditScale
+	}
+	info := CounterInfo{
+		Key:     key,
+		Product: entry.Product,
+		Package: entry.Package,
+		Name:    entry.Name,
+		Unit:    entry.Unit,
+		Used:    float64(used) / scale,
+		Limit:   float64(entry.Limit) / scale,
+		TTL:     int64(ttl.Seconds()),
+	}
+	if ttl > 0 {
+		resetAt := now.Add(ttl)
+		info.ResetAt = &resetAt
+	}
+	return info, true, nil
+}
+
+// ListUserCounters 列出用户在计数器索引中的计数器，product为空时列出所有产品
+// 已过期的计数器会从索引中清理
+func ListUserCounters(xuserid, product string) ([]CounterInfo, error) {
+	entries, err := readCounterIndex(xuserid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	counters := make([]CounterInfo, 0, len(entries))
+	var missing []string
+	for _, key := range sortedKeys(entries) {
+		entry := entries[key]
+		if product != "" && entry.Product != product {
+			continue
+		}
+		info, exists, err := counterInfo(key, entry, now)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, key)
+			continue
+		}
+		counters = append(counters, info)
+	}
+	if len(missing) > 0 {
+		if err := RedisClient.HDel(keys.RateLimitIndex(xuserid), missing...); err != nil {
+			return nil, fmt.Errorf("清理计数器索引失败: %w", err)
+		}
+	}
+	return counters, nil
+}
+
+// ResetUserCounters 删除用户的计数器，product和name为空时不按该条件过滤，返回删除的计数器键
+// name可以是计数器名称、模型名或模型别名
+func ResetUserCounters(xuserid, product, name string) ([]string, error) {
+	entries, err := readCounterIndex(xuserid)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, key := range sortedKeys(entries) {
+		entry := entries[key]
+		if (product != "" && entry.Product != product) || !entry.matchesCounter(name) {
+			continue
+		}
+		if err := RedisClient.Delete(key); err != nil {
+			return nil, fmt.Errorf("删除计数器失败: %w", err)
+		}
+		deleted = append(deleted, key)
+	}
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	if err := RedisClient.HDel(keys.RateLimitIndex(xuserid), deleted...); err != nil {
+		return nil, fmt.Errorf("更新计数器索引失败: %w", err)
+	}
+	return deleted, nil
+}
+
+// SetUserCounters 把用户当前套餐下的计数器设为指定的使用量，value使用计数器的计量单位（积分可以是小数）
+// name为空时设置当前套餐所有已存在的计数器；name对应的计数器还不存在时按unit（默认为消息数）新建，窗口从现在开始
+func SetUserCounters(pkg *UserPackage, name, unit string, value float64) ([]CounterInfo, error) {
+	if value < 0 {
+		return nil, fmt.Errorf("使用量不能为负数: %g", value)
+	}
+	xuserid, product, packageType := pkg.UserID, pkg.Product, pkg.Level
+
+	now := time.Now()
+	overrides, err := loadOverrides(xuserid, now)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readCounterIndex(xuserid)
+	if err != nil {
+		return nil, err
+	}
+
+	var counters []*limitCounter
+	seen := make(map[string]bool)
+	for _, key := range sortedKeys(entries) {
+		entry := entries[key]
+		if entry.Product != product || entry.Package != packageType || (unit != "" && entry.Unit != unit) || !entry.matchesCounter(name) {
+			continue
+		}
+		counter := counterForName(product, packageType, entry.Name, entry.Unit, xuserid, overrides, now)
+		if counter != nil && !seen[counter.key] {
+			seen[counter.key] = true
+			counters = append(counters, counter)
+		}
+	}
+	if len(counters) == 0 && name != "" {
+		if unit == "" {
+			unit = UnitMessage
+		}
+		if counter := counterForName(product, packageType, name, unit, xuserid, overrides, now); counter != nil {
+			counters = append(counters, counter)
+		}
+	}
+	if len(counters) == 0 {
+		return nil, fmt.Errorf("%w: 用户 %s 在产品 %s 的 %s 套餐下没有 %q 对应的计数器", ErrCounterNotFound, xuserid, product, packageType, name)
+	}
+
+	indexKey := keys.RateLimitIndex(xuserid)
+	var indexTTL time.Duration
+	infos := make([]CounterInfo, 0, len(counters))
+	for _, counter := range counters {
+		stored := int64(math.Round(value * float64(counter.scale())))
+		ttl, err := RedisClient.TTL(counter.key)
+		if err != nil {
+			return nil, fmt.Errorf("获取计数器过期时间失败: %w", err)
+		}
+		if ttl > 0 {
+			err = RedisClient.SetKeepTTL(counter.key, stored)
+		} else {
+			// 新建的计数器与正常请求一样，窗口从现在开始
+			_, periodEnd := counter.rule.Period(now)
+			ttl = periodEnd.Sub(now)
+			err = RedisClient.Set(counter.key, stored, ttl)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("设置计数器失败: %w", err)
+		}
+		if ttl > indexTTL {
+			indexTTL = ttl
+		}
+
+		entry, err := counter.indexEntry(product, packageType)
+		if err != nil {
+			return nil, err
+		}
+		if err := RedisClient.HSet(indexKey, counter.key, entry); err != nil {
+			return nil, fmt.Errorf("更新计数器索引失败: %w", err)
+		}
+		info, _, err := counterInfo(counter.key, counterIndexEntry{
+			Product: product,
+			Package: packageType,
+			Name:    counter.counterName,
+			Unit:    counter.unit,
+			Limit:   counter.max(),
+		}, now)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	// 索引不能早于计数器过期
+	if err := extendCounterIndex(indexKey, indexTTL); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
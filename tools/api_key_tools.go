@@ -0,0 +1,99 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// apiKeyPrefix API key的前缀，便于在日志和代码仓库中识别泄露的key
+const apiKeyPrefix = "lsk_"
+
+// APIKeyInfo 用户的一个API key，不包含key本身
+type APIKeyInfo struct {
+	ID        string    `json:"id"` // API key的SHA-256，用于吊销
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LookupAPIKey 返回API key对应的用户ID，key不存在时返回空字符串
+// Redis中只保存key的SHA-256，通过哈希直接查找，不需要逐个比较
+func LookupAPIKey(apiKey string) (string, error) {
+	if apiKey == "" {
+		return "", nil
+	}
+	xuserid, err := RedisClient.GetString(keys.APIKey(hashToken(apiKey)))
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("查询API key失败: %w", err)
+	}
+	return xuserid, nil
+}
+
+// CreateAPIKey 为用户创建一个API key，key只在创建时返回一次
+func CreateAPIKey(xuserid, name string) (string, *APIKeyInfo, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, fmt.Errorf("生成API key失败: %w", err)
+	}
+	apiKey := apiKeyPrefix + hex.EncodeToString(buf)
+
+	info := &APIKeyInfo{ID: hashToken(apiKey), Name: name, CreatedAt: time.Now()}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", nil, fmt.Errorf("序列化API key失败: %w", err)
+	}
+	// 两个键可能位于不同的槽位，先写入用户的key列表，失败时不会留下无法吊销的key
+	if err := RedisClient.HSet(keys.UserAPIKeys(xuserid), info.ID, string(data)); err != nil {
+		return "", nil, fmt.Errorf("保存API key失败: %w", err)
+	}
+	if err := RedisClient.Set(keys.APIKey(info.ID), xuserid, 0); err != nil {
+		return "", nil, fmt.Errorf("保存API key失败: %w", err)
+	}
+	return apiKey, info, nil
+}
+
+// ListAPIKeys 返回用户的所有API key，最早创建的在前
+func ListAPIKeys(xuserid string) ([]APIKeyInfo, error) {
+	fields, err := RedisClient.HGetAll(keys.UserAPIKeys(xuserid))
+	if err != nil {
+		return nil, fmt.Errorf("获取API key失败: %w", err)
+	}
+	result := make([]APIKeyInfo, 0, len(fields))
+	for id, data := range fields {
+		var info APIKeyInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			fmt.Printf("解析API key %s 失败: %v\n", id, err)
+			info = APIKeyInfo{}
+		}
+		info.ID = id
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result, nil
+}
+
+// RevokeAPIKey 吊销用户的一个API key，返回key是否存在
+func RevokeAPIKey(xuserid, id string) (bool, error) {
+	fields, err := RedisClient.HGetAll(keys.UserAPIKeys(xuserid))
+	if err != nil {
+		return false, fmt.Errorf("获取API key失败: %w", err)
+	}
+	if _, exists := fields[id]; !exists {
+		return false, nil
+	}
+	if err := RedisClient.Delete(keys.APIKey(id)); err != nil {
+		return false, fmt.Errorf("吊销API key失败: %w", err)
+	}
+	if err := RedisClient.HDel(keys.UserAPIKeys(xuserid), id); err != nil {
+		return false, fmt.Errorf("吊销API key失败: %w", err)
+	}
+	return true, nil
+}
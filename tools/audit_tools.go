@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	ahocorasick "github.com/petar-dambovaliev/aho-corasick"
+	"limit_service/config"
 )
 
 // 全局Aho-Corasick自动机
@@ -16,7 +17,7 @@ var automatonInitialized bool
 // InitKeyWords 初始化关键词自动机
 func InitKeyWords() error {
 	// 读取关键词文件
-	file, err := os.Open("./data/keywords.txt")
+	file, err := os.Open(config.GetConfig().Paths.Keywords)
 	if err != nil {
 		return fmt.Errorf("打开关键词文件失败: %w", err)
 	}
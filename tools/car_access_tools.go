@@ -0,0 +1,162 @@
+package tools
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// CarAccessData 车权限矩阵
+// levels 按套餐等级配置可以使用的车标签，"*" 为没有单独配置的等级使用的规则，没有 "*" 时这些等级可以使用任何车；
+// users 按用户ID配置可以或不可以使用的车ID，命中时优先于套餐等级的规则
+type CarAccessData struct {
+	Levels map[string]*CarAccessRule `json:"levels"` // 套餐等级 -> 车标签规则
+	Users  map[string]*CarAccessRule `json:"users"`  // 用户ID -> 车ID规则
+}
+
+// CarAccessRule 允许和禁止列表，支持 "*"、"plus-*" 这样的通配模式，同时命中时禁止优先
+type CarAccessRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// decide 判断规则是否允许value，两个列表都没有命中时decided为false
+func (r *CarAccessRule) decide(value string) (allowed, decided bool) {
+	if matchAny(r.Deny, value) {
+		return false, true
+	}
+	if matchAny(r.Allow, value) {
+		return true, true
+	}
+	return false, false
+}
+
+// allowsAll 判断规则是否允许所有值，此时不需要读取车的状态
+func (r *CarAccessRule) allowsAll() bool {
+	if len(r.Deny) > 0 {
+		return false
+	}
+	for _, pattern := range r.Allow {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny 判断value是否命中任意一个通配模式
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCarAccess 未配置 car_access 时使用的规则：免费、迷你和基础套餐只能使用标签为mini或free的车
+func defaultCarAccess() *CarAccessData {
+	restricted := &CarAccessRule{Allow: []string{"mini", "free"}}
+	return &CarAccessData{
+		Levels: map[string]*CarAccessRule{
+			"free": restricted,
+			"mini": restricted,
+			"base": restricted,
+		},
+	}
+}
+
+// carAccessPolicy 加载后的车权限矩阵，套餐等级和车标签统一为小写
+type carAccessPolicy struct {
+	levels map[string]*CarAccessRule
+	users  map[string]*CarAccessRule
+}
+
+// buildCarAccess 校验并加载车权限矩阵，data为nil时使用默认规则
+func buildCarAccess(data *CarAccessData) (*carAccessPolicy, []string) {
+	if data == nil {
+		data = defaultCarAccess()
+	}
+	policy := &carAccessPolicy{
+		levels: make(map[string]*CarAccessRule, len(data.Levels)),
+		users:  make(map[string]*CarAccessRule, len(data.Users)),
+	}
+	var errs []string
+
+	for _, level := range sortedKeys(data.Levels) {
+		rule, ruleErrs := buildCarAccessRule(data.Levels[level], "car_access.levels."+level, true)
+		errs = append(errs, ruleErrs...)
+		policy.levels[strings.ToLower(level)] = rule
+	}
+	for _, xuserid := range sortedKeys(data.Users) {
+		rule, ruleErrs := buildCarAccessRule(data.Users[xuserid], "car_access.users."+xuserid, false)
+		errs = append(errs, ruleErrs...)
+		policy.users[xuserid] = rule
+	}
+	return policy, errs
+}
+
+// buildCarAccessRule 校验规则中的通配模式，lower为true时（车标签）统一为小写
+func buildCarAccessRule(rule *CarAccessRule, rulePath string, lower bool) (*CarAccessRule, []string) {
+	if rule == nil {
+		return nil, []string{rulePath + ": 规则不能为空"}
+	}
+	var errs []string
+	normalize := func(patterns []string, name string) []string {
+		result := make([]string, 0, len(patterns))
+		for i, pattern := range patterns {
+			if lower {
+				pattern = strings.ToLower(pattern)
+			}
+			if _, err := path.Match(pattern, ""); pattern == "" || err != nil {
+				errs = append(errs, fmt.Sprintf("%s.%s[%d]: 无效的通配模式 %q", rulePath, name, i, pattern))
+				continue
+			}
+			result = append(result, pattern)
+		}
+		return result
+	}
+	return &CarAccessRule{
+		Allow: normalize(rule.Allow, "allow"),
+		Deny:  normalize(rule.Deny, "deny"),
+	}, errs
+}
+
+// levelRule 返回套餐等级使用的车标签规则，返回nil表示可以使用任何车
+func (p *carAccessPolicy) levelRule(level string) *CarAccessRule {
+	if rule, exists := p.levels[level]; exists {
+		return rule
+	}
+	return p.levels["*"]
+}
+
+// userDecision 按用户单独配置的车ID规则判断，用户没有配置或没有命中时decided为false
+func (p *carAccessPolicy) userDecision(xuserid, carid string) (allowed, decided bool) {
+	if rule, exists := p.users[xuserid]; exists {
+		return rule.decide(carid)
+	}
+	return false, false
+}
+
+// allows 判断用户的套餐能否使用指定的车：先看用户的车ID规则，再看套餐等级的车标签规则
+func (p *carAccessPolicy) allows(pkg *UserPackage, car CarInfo) bool {
+	if allowed, decided := p.userDecision(pkg.UserID, car.CarID); decided {
+		return allowed
+	}
+	rule := p.levelRule(pkg.Level)
+	if rule == nil {
+		return true
+	}
+	allowed, _ := rule.decide(car.Label)
+	return allowed
+}
+
+// carPolicy 返回当前生效的车权限矩阵
+func (s *limitSet) carPolicy() *carAccessPolicy {
+	if s.carAccess == nil {
+		// 限速配置加载之前使用默认规则
+		policy, _ := buildCarAccess(nil)
+		return policy
+	}
+	return s.carAccess
+}
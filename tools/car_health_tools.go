@@ -0,0 +1,193 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// ErrUnknownOutcome 上报的上游请求结果无法识别
+var ErrUnknownOutcome = errors.New("未知的上游请求结果")
+
+// ErrUnknownCar 上报的车不在车目录中
+var ErrUnknownCar = errors.New("未知的车")
+
+// 代理上报的上游请求结果
+const (
+	CarOutcomeSuccess = "success" // 请求成功
+	CarOutcome429     = "429"     // 上游限流
+	CarOutcome401     = "401"     // 账号失效或被封
+	CarOutcome5xx     = "5xx"     // 上游服务错误
+)
+
+// 车不能使用的原因，返回给前端用于区分提示
+const (
+	CarDeniedNotAllowed = "car_not_allowed" // 套餐或用户的车权限规则不允许
+	CarDeniedUnhealthy  = "car_unhealthy"   // 上游错误过多，车被暂时隔离
+	CarDeniedBusy       = "car_busy"        // 车的并发已满
+	CarDeniedRPM        = "car_rpm"         // 车的请求频率超限
+)
+
+// carHealthScript 记录一次上游请求结果，窗口内错误率达到阈值时隔离车
+// KEYS[1] 窗口内的所有结果，KEYS[2] 窗口内的错误（都是有序集合，分数为上报时间），KEYS[3] 隔离状态
+// ARGV: 当前毫秒时间、窗口毫秒数、上报ID、是否为错误(0/1)、最少上报次数、错误率阈值、隔离毫秒数、结果
+// 返回: 1 本次上报导致车被隔离，否则为0
+var carHealthScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now - window)
+redis.call('ZADD', KEYS[1], now, ARGV[3])
+redis.call('PEXPIRE', KEYS[1], window)
+if ARGV[4] == '1' then
+	redis.call('ZADD', KEYS[2], now, ARGV[3])
+	redis.call('PEXPIRE', KEYS[2], window)
+end
+
+if ARGV[4] ~= '1' or redis.call('EXISTS', KEYS[3]) == 1 then
+	return 0
+end
+local total = redis.call('ZCARD', KEYS[1])
+local errors = redis.call('ZCARD', KEYS[2])
+if total >= tonumber(ARGV[5]) and errors >= total * tonumber(ARGV[6]) then
+	redis.call('SET', KEYS[3], ARGV[8], 'PX', ARGV[7])
+	-- 冷却结束后重新开始统计
+	redis.call('DEL', KEYS[1], KEYS[2])
+	return 1
+end
+return 0
+`)
+
+// NormalizeCarOutcome 把上报的结果统一为 CarOutcome* 常量，支持具体的状态码如 "200"、"502"
+func NormalizeCarOutcome(outcome string) (string, error) {
+	outcome = strings.ToLower(strings.TrimSpace(outcome))
+	switch {
+	case outcome == CarOutcomeSuccess || outcome == "200":
+		return CarOutcomeSuccess, nil
+	case outcome == CarOutcome429 || outcome == CarOutcome401:
+		return outcome, nil
+	case outcome == "403":
+		return CarOutcome401, nil
+	case outcome == CarOutcome5xx || (len(outcome) == 3 && outcome[0] == '5' && strings.Trim(outcome[1:], "0123456789") == ""):
+		return CarOutcome5xx, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownOutcome, outcome)
+	}
+}
+
+// RecordCarOutcome 记录车的一次上游请求结果，返回本次上报是否导致车被隔离
+// 窗口内上报次数达到 policies.car_health_min_samples 且错误率达到 policies.car_health_error_rate 时，
+// 车被隔离 policies.car_quarantine，期间 VerifyUserAcard 拒绝使用该车，推荐时也会跳过
+// 车不在车目录中时返回 ErrUnknownCar，不为不存在的车创建统计
+func RecordCarOutcome(carid, outcome string) (bool, error) {
+	outcome, err := NormalizeCarOutcome(outcome)
+	if err != nil {
+		return false, err
+	}
+	known, err := Cars.Has(carid)
+	if err != nil {
+		return false, err
+	}
+	if !known {
+		return false, fmt.Errorf("%w: %q", ErrUnknownCar, carid)
+	}
+	id, err := randomID()
+	if err != nil {
+		return false, err
+	}
+
+	policies := config.GetConfig().Policies
+	isError := 0
+	if outcome != CarOutcomeSuccess {
+		isError = 1
+	}
+	result, err := RedisClient.RunScript(carHealthScript,
+		[]string{keys.CarOutcomes(carid), keys.CarErrors(carid), keys.CarQuarantine(carid)},
+		time.Now().UnixMilli(), policies.CarHealthWindow.Milliseconds(), id, isError,
+		policies.CarHealthMinSamples, policies.CarHealthErrorRate, policies.CarQuarantine.Milliseconds(), outcome)
+	if err != nil {
+		return false, fmt.Errorf("记录车上游结果失败: %w", err)
+	}
+
+	status, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("车健康脚本返回值格式错误: %v", result)
+	}
+	quarantined := status == 1
+	if quarantined {
+		// 车目录缓存中的健康状态需要立即更新
+		Cars.Invalidate()
+		fmt.Printf("车 %s 在 %s 内上游错误率过高（最近一次为 %s），隔离 %s\n",
+			carid, policies.CarHealthWindow, outcome, policies.CarQuarantine)
+	}
+	return quarantined, nil
+}
+
+// carQuarantined 判断车是否处于隔离中
+func carQuarantined(carid string) (bool, error) {
+	quarantined, err := RedisClient.Exists(keys.CarQuarantine(carid))
+	if err != nil {
+		return false, fmt.Errorf("获取车隔离状态失败: %w", err)
+	}
+	return quarantined, nil
+}
+
+// CarHealth 车在统计窗口内的健康状态
+type CarHealth struct {
+	CarID       string     `json:"carid"`
+	Requests    int64      `json:"requests"` // 窗口内的上报次数，隔离时清零
+	Errors      int64      `json:"errors"`
+	Quarantined bool       `json:"quarantined"`
+	Outcome     string     `json:"outcome,omitempty"` // 导致隔离的上游结果
+	Until       *time.Time `json:"until,omitempty"`   // 隔离结束时间
+}
+
+// GetCarHealth 返回车的健康状态
+func GetCarHealth(carid string) (*CarHealth, error) {
+	now := time.Now()
+	from := now.Add(-config.GetConfig().Policies.CarHealthWindow).UnixMilli()
+	health := &CarHealth{CarID: carid}
+
+	var err error
+	if health.Requests, err = RedisClient.ZCount(keys.CarOutcomes(carid), from, now.UnixMilli()); err != nil {
+		return nil, fmt.Errorf("获取车上游结果失败: %w", err)
+	}
+	if health.Errors, err = RedisClient.ZCount(keys.CarErrors(carid), from, now.UnixMilli()); err != nil {
+		return nil, fmt.Errorf("获取车上游错误失败: %w", err)
+	}
+
+	quarantineKey := keys.CarQuarantine(carid)
+	outcome, err := RedisClient.GetString(quarantineKey)
+	if err == redis.Nil {
+		return health, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("获取车隔离状态失败: %w", err)
+	}
+	health.Quarantined, health.Outcome = true, outcome
+	if ttl, err := RedisClient.TTL(quarantineKey); err == nil && ttl > 0 {
+		until := now.Add(ttl)
+		health.Until = &until
+	}
+	return health, nil
+}
+
+// ClearCarQuarantine 提前解除车的隔离并清空统计，返回车之前是否处于隔离中
+func ClearCarQuarantine(carid string) (bool, error) {
+	quarantined, err := carQuarantined(carid)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range []string{keys.CarQuarantine(carid), keys.CarOutcomes(carid), keys.CarErrors(carid)} {
+		if err := RedisClient.Delete(key); err != nil {
+			return false, fmt.Errorf("解除车隔离失败: %w", err)
+		}
+	}
+	Cars.Invalidate()
+	return quarantined, nil
+}
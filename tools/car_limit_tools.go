@@ -0,0 +1,187 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// carRPMWindow 车请求频率的统计窗口
+const carRPMWindow = time.Minute
+
+// carSlotScript 的返回值
+const (
+	carSlotOK          = 0
+	carSlotRPM         = 1
+	carSlotConcurrency = 2
+)
+
+// carSlotScript 原子地检查并占用车的请求频率和并发名额
+// KEYS[1] 最近一分钟的请求记录（有序集合，分数为请求时间），KEYS[2] 正在处理的请求（有序集合，分数为名额的过期时间）
+// ARGV: 当前毫秒时间、每分钟请求上限、并发上限（0表示不限制）、请求ID、名额过期的毫秒时间、统计窗口毫秒数
+// 返回: 0 成功，1 超过请求频率，2 超过并发
+var carSlotScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rpm = tonumber(ARGV[2])
+local concurrency = tonumber(ARGV[3])
+local window = tonumber(ARGV[6])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if rpm > 0 and redis.call('ZCARD', KEYS[1]) >= rpm then
+	return 1
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if concurrency > 0 and redis.call('ZCARD', KEYS[2]) >= concurrency then
+	return 2
+end
+
+if rpm > 0 then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+end
+if concurrency > 0 then
+	redis.call('ZADD', KEYS[2], ARGV[5], ARGV[4])
+	local pttl = redis.call('PTTL', KEYS[2])
+	if pttl < 0 or now + pttl < tonumber(ARGV[5]) then
+		redis.call('PEXPIREAT', KEYS[2], ARGV[5])
+	end
+end
+return 0
+`)
+
+// CarLimitData 车的负载上限，0表示不限制
+type CarLimitData struct {
+	RPM         int `json:"rpm"`         // 每分钟请求数
+	Concurrency int `json:"concurrency"` // 同时处理的请求数
+}
+
+// buildCarLimits 校验并加载按车标签配置的默认负载上限，"*" 为没有单独配置的标签使用的上限
+func buildCarLimits(data map[string]*CarLimitData) (map[string]CarLimitData, []string) {
+	result := make(map[string]CarLimitData, len(data))
+	var errs []string
+	for _, label := range sortedKeys(data) {
+		limit := data[label]
+		switch {
+		case limit == nil:
+			errs = append(errs, fmt.Sprintf("car_limits.%s: 上限不能为空", label))
+		case limit.RPM < 0 || limit.Concurrency < 0:
+			errs = append(errs, fmt.Sprintf("car_limits.%s: rpm 和 concurrency 不能为负数", label))
+		default:
+			result[strings.ToLower(label)] = *limit
+		}
+	}
+	return result, errs
+}
+
+// carLimit 返回车的负载上限：车状态中的 rpm、concurrency 字段优先，未设置的按车标签的默认值
+func (s *limitSet) carLimit(car CarInfo) CarLimitData {
+	limit, exists := s.carLimits[car.Label]
+	if !exists {
+		limit = s.carLimits["*"]
+	}
+	if car.RPM > 0 {
+		limit.RPM = car.RPM
+	}
+	if car.Concurrency > 0 {
+		limit.Concurrency = car.Concurrency
+	}
+	return limit
+}
+
+// concurrencyEnabled 返回并发上限是否生效
+// 并发名额只能由代理调用 /audit/complete 释放，未配置 service.token 时该接口不开放，名额只能等超时失效，因此不限制并发
+func concurrencyEnabled() bool {
+	return config.GetConfig().Service.Token != ""
+}
+
+// CarSlot 一次请求在车上占用的名额
+type CarSlot struct {
+	CarID   string
+	LeaseID string // 并发名额的ID，车没有并发上限时为空，不需要释放
+}
+
+// randomID 生成随机ID，用于名额和上报记录
+func randomID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成随机ID失败: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// AcquireCarSlot 为一次请求占用车的请求频率和并发名额
+// 参数: leaseID - 本次请求已经占用的用户并发名额ID，车的并发名额使用同一个ID，为空时生成新的ID
+// 返回: (占用的名额, 拒绝原因, 错误)，名额为nil时原因为 CarDeniedRPM 或 CarDeniedBusy
+// 并发名额需要在请求完成后通过 ReleaseCarSlot 释放，没有释放的名额在 policies.car_lease_timeout 后自动失效；
+// 未配置 service.token 时只限制请求频率，见 concurrencyEnabled
+func AcquireCarSlot(carid, leaseID string) (*CarSlot, string, error) {
+	slot := &CarSlot{CarID: carid}
+	if carid == "" {
+		return slot, "", nil
+	}
+
+	// 车状态不存在或格式错误时按 "*" 的默认上限处理
+	car := CarInfo{CarID: carid}
+	value, err := RedisClient.Get(keys.CarStatus(carid))
+	if err != nil {
+		return nil, "", fmt.Errorf("获取车状态信息失败: %w", err)
+	}
+	if value != nil {
+		if parsed, err := parseCarInfo(carid, value); err == nil {
+			car = parsed
+		}
+	}
+	limit := currentLimits().carLimit(car)
+	if !concurrencyEnabled() {
+		limit.Concurrency = 0
+	}
+	if limit.RPM == 0 && limit.Concurrency == 0 {
+		return slot, "", nil
+	}
+
+	if leaseID == "" {
+		if leaseID, err = randomID(); err != nil {
+			return nil, "", err
+		}
+	}
+	now := time.Now()
+	expireAt := now.Add(config.GetConfig().Policies.CarLeaseTimeout)
+	result, err := RedisClient.RunScript(carSlotScript,
+		[]string{keys.CarRPM(carid), keys.CarInflight(carid)},
+		now.UnixMilli(), limit.RPM, limit.Concurrency, leaseID, expireAt.UnixMilli(), carRPMWindow.Milliseconds())
+	if err != nil {
+		return nil, "", fmt.Errorf("检查车负载失败: %w", err)
+	}
+
+	status, ok := result.(int64)
+	if !ok {
+		return nil, "", fmt.Errorf("车负载脚本返回值格式错误: %v", result)
+	}
+	switch status {
+	case carSlotRPM:
+		return nil, CarDeniedRPM, nil
+	case carSlotConcurrency:
+		return nil, CarDeniedBusy, nil
+	}
+	if limit.Concurrency > 0 {
+		slot.LeaseID = leaseID
+	}
+	return slot, "", nil
+}
+
+// ReleaseCarSlot 释放请求占用的并发名额，返回名额是否存在（已释放或已过期时为false）
+func ReleaseCarSlot(carid, leaseID string) (bool, error) {
+	if carid == "" || leaseID == "" {
+		return false, nil
+	}
+	removed, err := RedisClient.ZRem(keys.CarInflight(carid), leaseID)
+	if err != nil {
+		return false, fmt.Errorf("释放车并发名额失败: %w", err)
+	}
+	return removed > 0, nil
+}
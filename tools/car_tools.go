@@ -0,0 +1,192 @@
+package tools
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"limit_service/config"
+)
+
+// CarInfo 车目录中一辆车的状态
+// 状态来自主应用写入的 car_status:{carid}，除 label 外的字段都是可选的
+type CarInfo struct {
+	CarID   string  `json:"carid"`
+	Label   string  `json:"label"`
+	Healthy bool    `json:"healthy"` // 对应 healthy 字段，缺省为true；被隔离的车为false
+	Load    float64 `json:"load"`    // 对应 load 字段，数值越小越空闲，缺省为0
+
+	RPM         int `json:"-"` // 对应 rpm 字段，每分钟请求上限，缺省按车标签的默认值
+	Concurrency int `json:"-"` // 对应 concurrency 字段，并发上限，缺省按车标签的默认值
+}
+
+// parseCarInfo 解析车状态，格式不正确时返回错误
+func parseCarInfo(carid string, value interface{}) (CarInfo, error) {
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return CarInfo{}, fmt.Errorf("车数据格式错误")
+	}
+	label, ok := data["label"].(string)
+	if !ok {
+		return CarInfo{}, fmt.Errorf("车标签数据格式错误")
+	}
+	car := CarInfo{CarID: carid, Label: strings.ToLower(label), Healthy: true}
+	if healthy, ok := data["healthy"].(bool); ok {
+		car.Healthy = healthy
+	}
+	if load, ok := data["load"].(float64); ok {
+		car.Load = load
+	}
+	if rpm, ok := data["rpm"].(float64); ok && rpm > 0 {
+		car.RPM = int(rpm)
+	}
+	if concurrency, ok := data["concurrency"].(float64); ok && concurrency > 0 {
+		car.Concurrency = int(concurrency)
+	}
+	return car, nil
+}
+
+// CarDirectory 扫描所有车的状态，结果在进程内缓存一小段时间
+// 扫描在锁外进行，完成后替换缓存，扫描期间其他请求继续使用旧的结果或同时扫描
+type CarDirectory struct {
+	ttl        time.Duration
+	mu         sync.Mutex
+	cars       []CarInfo
+	fetchedAt  time.Time
+	generation uint64 // Invalidate时递增，扫描期间被清空的缓存不会被扫描结果覆盖
+}
+
+// 全局车目录，InitCarDirectory时根据配置替换
+var Cars = NewCarDirectory(0)
+
+// NewCarDirectory 创建车目录，ttl为0时每次重新扫描
+func NewCarDirectory(ttl time.Duration) *CarDirectory {
+	return &CarDirectory{ttl: ttl}
+}
+
+// InitCarDirectory 根据配置初始化全局车目录
+func InitCarDirectory() {
+	Cars = NewCarDirectory(config.GetConfig().Policies.CarDirectoryTTL)
+	fmt.Printf("车目录初始化完成，缓存时间 %s\n", Cars.ttl)
+}
+
+// List 返回所有车的状态，按车ID排序，格式错误的车会被跳过
+func (d *CarDirectory) List() ([]CarInfo, error) {
+	now := time.Now()
+	d.mu.Lock()
+	if d.ttl > 0 && d.cars != nil && now.Sub(d.fetchedAt) < d.ttl {
+		cars := d.cars
+		d.mu.Unlock()
+		return cars, nil
+	}
+	generation := d.generation
+	d.mu.Unlock()
+
+	cars, err := scanCars()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.generation == generation && (d.cars == nil || !now.Before(d.fetchedAt)) {
+		d.cars, d.fetchedAt = cars, now
+	}
+	d.mu.Unlock()
+	return cars, nil
+}
+
+// scanCars 扫描所有车的状态，按车ID排序
+func scanCars() ([]CarInfo, error) {
+	statusKeys, err := RedisClient.ScanKeys(keys.CarStatusPattern())
+	if err != nil {
+		return nil, fmt.Errorf("扫描车状态失败: %w", err)
+	}
+	cars := make([]CarInfo, 0, len(statusKeys))
+	for _, key := range statusKeys {
+		carid, ok := keys.CarIDFromStatusKey(key)
+		if !ok {
+			continue
+		}
+		value, err := RedisClient.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("获取车状态信息失败: %w", err)
+		}
+		if value == nil {
+			continue // 扫描之后被删除
+		}
+		car, err := parseCarInfo(carid, value)
+		if err != nil {
+			fmt.Printf("车 %s 的状态无法解析，已跳过: %v\n", carid, err)
+			continue
+		}
+		quarantined, err := carQuarantined(carid)
+		if err != nil {
+			return nil, err
+		}
+		if quarantined {
+			car.Healthy = false
+		}
+		cars = append(cars, car)
+	}
+	sort.Slice(cars, func(i, j int) bool { return cars[i].CarID < cars[j].CarID })
+	return cars, nil
+}
+
+// Has 返回车目录中是否有该车
+// 缓存中没有时直接检查车状态是否存在，新增的车不需要等到 policies.car_directory_ttl 之后，找到时清空缓存
+func (d *CarDirectory) Has(carid string) (bool, error) {
+	cars, err := d.List()
+	if err != nil {
+		return false, err
+	}
+	i := sort.Search(len(cars), func(i int) bool { return cars[i].CarID >= carid })
+	if i < len(cars) && cars[i].CarID == carid {
+		return true, nil
+	}
+
+	exists, err := RedisClient.Exists(keys.CarStatus(carid))
+	if err != nil {
+		return false, fmt.Errorf("获取车状态信息失败: %w", err)
+	}
+	if exists {
+		d.Invalidate()
+	}
+	return exists, nil
+}
+
+// Invalidate 清空缓存，下次调用List时重新扫描
+func (d *CarDirectory) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cars = nil
+	d.generation++
+}
+
+// RecommendCars 返回套餐可以使用的健康车，负载最低的在前，不包括用户当前所在的车
+// 数量由 policies.car_recommendations 配置
+func RecommendCars(pkg *UserPackage, currentCarID string) ([]CarInfo, error) {
+	limit := config.GetConfig().Policies.CarRecommendations
+	if limit == 0 {
+		return nil, nil
+	}
+	cars, err := Cars.List()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := currentLimits().carPolicy()
+	var allowed []CarInfo
+	for _, car := range cars {
+		if car.CarID != currentCarID && car.Healthy && policy.allows(pkg, car) {
+			allowed = append(allowed, car)
+		}
+	}
+	// cars已按车ID排序，稳定排序保证负载相同时结果固定
+	sort.SliceStable(allowed, func(i, j int) bool { return allowed[i].Load < allowed[j].Load })
+	if len(allowed) > limit {
+		allowed = allowed[:limit]
+	}
+	return allowed, nil
+}
@@ -2,88 +2,65 @@ package tools
 
 import (
 	"fmt"
-	"strings"
-
-	"github.com/go-redis/redis/v8"
 )
 
-// VerifyTokenNoHeader 验证用户token（不使用header）
+// VerifyTokenNoHeader 验证用户token（不使用header），支持签名token、会话token和旧的单一token，见 verifyToken
 func VerifyTokenNoHeader(xuserid, xtoken string) (bool, error) {
-	expectedToken, err := RedisClient.GetString(fmt.Sprintf("xtoken_%s", xuserid))
-	if err != nil {
-		if err == redis.Nil {
-			return false, nil // token不存在
-		}
-		return false, err
-	}
-	
-	return xtoken == expectedToken, nil
+	return verifyToken(xuserid, xtoken)
 }
 
-// VerifyUserAcard 校验用户是否可以在指定车提问
-// 参数: xuserid - 用户ID, carid - 车ID
-// 返回: true表示可以提问
-func VerifyUserAcard(xuserid, carid string) (bool, error) {
-	// 获取用户激活的套餐信息
-	redisUserData, err := RedisClient.Get(fmt.Sprintf("user:%s:active_packages", xuserid))
-	if err != nil {
-		return false, fmt.Errorf("获取用户套餐信息失败: %w", err)
-	}
-
-	var level string
-	if redisUserData == nil {
-		level = "free"
-	} else {
-		// 解析用户数据
-		userData, ok := redisUserData.(map[string]interface{})
-		if !ok {
-			return false, fmt.Errorf("用户数据格式错误")
+// VerifyUserAcard 校验用户是否可以在指定车提问，规则见 limit.json 的 car_access
+// 参数: pkg - 用户在请求产品下生效的套餐, carid - 车ID
+// 返回: (true表示可以提问, 不能提问的原因 CarDenied*, 错误)
+func VerifyUserAcard(pkg *UserPackage, carid string) (bool, string, error) {
+	// 被隔离的车对所有用户都不可用
+	if carid != "" {
+		quarantined, err := carQuarantined(carid)
+		if err != nil {
+			return false, "", err
 		}
-		
-		chatgptData, ok := userData["ChatGPT"].(map[string]interface{})
-		if !ok {
-			level = "free"
-		} else {
-			levelData, ok := chatgptData["level"].(string)
-			if !ok {
-				level = "free"
-			} else {
-				level = strings.ToLower(levelData)
-			}
+		if quarantined {
+			return false, CarDeniedUnhealthy, nil
 		}
 	}
 
-	// 如果不是免费号或基础号，可以使用任何车
-	if level != "free" && level != "base" && level != "mini" {
-		return true, nil
+	policy := currentLimits().carPolicy()
+
+	// 用户单独配置的车ID规则优先
+	if allowed, decided := policy.userDecision(pkg.UserID, carid); decided {
+		return carDecision(allowed)
+	}
+
+	// 套餐等级可以使用任何车时不需要读取车状态
+	rule := policy.levelRule(pkg.Level)
+	if rule == nil || rule.allowsAll() {
+		return true, "", nil
 	}
 
 	// 获取车的状态信息
-	redisCarData, err := RedisClient.Get(fmt.Sprintf("car_status:%s", carid))
+	redisCarData, err := RedisClient.Get(keys.CarStatus(carid))
 	if err != nil {
-		return false, fmt.Errorf("获取车状态信息失败: %w", err)
+		return false, "", fmt.Errorf("获取车状态信息失败: %w", err)
 	}
 
 	if redisCarData == nil {
-		return false, fmt.Errorf("车状态信息不存在")
+		return false, "", fmt.Errorf("车状态信息不存在")
 	}
 
-	carData, ok := redisCarData.(map[string]interface{})
-	if !ok {
-		return false, fmt.Errorf("车数据格式错误")
+	car, err := parseCarInfo(carid, redisCarData)
+	if err != nil {
+		return false, "", err
 	}
 
-	carLabelData, ok := carData["label"].(string)
-	if !ok {
-		return false, fmt.Errorf("车标签数据格式错误")
-	}
+	// 按车标签判断，没有命中允许列表的车不能使用
+	allowed, _ := rule.decide(car.Label)
+	return carDecision(allowed)
+}
 
-	carLabel := strings.ToLower(carLabelData)
-	
-	// 如果车标签是mini或free，允许访问
-	if carLabel == "mini" || carLabel == "free" {
-		return true, nil
+// carDecision 把车权限规则的判断结果转换为 VerifyUserAcard 的返回值
+func carDecision(allowed bool) (bool, string, error) {
+	if allowed {
+		return true, "", nil
 	}
-
-	return false, nil
+	return false, CarDeniedNotAllowed, nil
 } 
\ No newline at end of file
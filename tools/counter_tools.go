@@ -0,0 +1,373 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// limitScript 原子地检查并递增多个计数器，任意一个超限时都不递增
+// KEYS[1]: 用户的计数器索引，KEYS[2..]: 计数器键，需位于同一哈希槽
+// ARGV[1]: 当前时间(毫秒时间戳)；之后每个计数器依次为 上限、增量、过期时间点(毫秒时间戳)、索引字段(不含前缀的键)、索引信息
+// 返回数组，第一个元素为0表示全部通过并已递增，之后依次为每个计数器递增后的过期时间点(毫秒时间戳)；
+// 否则只有一个元素，为第一个超限计数器的序号(从1开始)
+var limitScript = redis.NewScript(`
+local index = KEYS[1]
+for i = 2, #KEYS do
+	local base = (i - 2) * 5 + 1
+	local current = tonumber(redis.call('GET', KEYS[i]) or '0')
+	if current + tonumber(ARGV[base + 2]) > tonumber(ARGV[base + 1]) then
+		return {i - 1}
+	end
+end
+local result = {0}
+local indexExpireAt = 0
+for i = 2, #KEYS do
+	local base = (i - 2) * 5 + 1
+	redis.call('INCRBY', KEYS[i], ARGV[base + 2])
+	if redis.call('PTTL', KEYS[i]) < 0 then
+		redis.call('PEXPIREAT', KEYS[i], ARGV[base + 3])
+	end
+	redis.call('HSET', index, ARGV[base + 4], ARGV[base + 5])
+	local expireAt = tonumber(ARGV[1]) + redis.call('PTTL', KEYS[i])
+	result[#result + 1] = expireAt
+	if expireAt > indexExpireAt then
+		indexExpireAt = expireAt
+	end
+end
+-- 索引在最晚过期的计数器之后过期
+local pttl = redis.call('PTTL', index)
+if pttl < 0 or tonumber(ARGV[1]) + pttl < indexExpireAt then
+	redis.call('PEXPIREAT', index, indexExpireAt)
+end
+return result
+`)
+
+// creditScale 积分计数器以千分之一积分为单位存储，避免使用浮点数计数
+const creditScale = 1000
+
+// tokenCounterSuffix token计数器在名称后加的后缀，与同名的消息计数器区分
+const tokenCounterSuffix = ":tok"
+
+// limitCounter 一次请求需要检查的计数器
+type limitCounter struct {
+	name        string         // 展示用的名称：模型规则名、组名或积分
+	counterName string         // 计数器键中的名称，token计数器不含后缀
+	group       string         // 共享额度组名，模型计数器为空
+	unit        string         // 计量单位，见 Unit* 常量
+	rule        *LimitRule     // 计数器使用的规则
+	key         string         // Redis键
+	increment   int64          // 本次请求的增量，积分计数器为千分之一积分
+	expireAt    int64          // 递增后计数器的过期时间点(毫秒时间戳)，用于退还时判断计数器是否仍在同一个窗口
+	override    *LimitOverride // 生效的用户覆盖
+}
+
+// scale 计数器的存储单位
+func (c *limitCounter) scale() int64 {
+	if c.unit == UnitCredit {
+		return creditScale
+	}
+	return 1
+}
+
+// max 计数器的上限，与increment使用相同的单位
+func (c *limitCounter) max() int64 {
+	return int64(c.rule.Count) * c.scale()
+}
+
+// description 计数器限制对象的描述，如 "gpt-4o模型" 或 "gpt-4o模型所在的共享额度组4o（gpt-4o、gpt-4o-canmore）"
+func (c *limitCounter) description(model string) string {
+	if c.group == "" {
+		return model + "模型"
+	}
+	return fmt.Sprintf("%s模型所在的共享额度组%s（%s）", model, c.group, strings.Join(currentLimits().data.Groups[c.group], "、"))
+}
+
+// deniedMessage 计数器超限时给用户的提示
+func (c *limitCounter) deniedMessage(packageType, model string, tokens int) string {
+	rule := c.rule
+	switch c.unit {
+	case UnitCredit:
+		return fmt.Sprintf("超过积分额度：在该%s套餐下，每%s共有%d积分，%s模型每条消息消耗%g积分，请稍后重试或升级套餐。",
+			packageType, rule.WindowText(), rule.Count, model, float64(c.increment)/creditScale)
+	case UnitToken:
+		return fmt.Sprintf("超过速率限制：在该%s套餐下，%s每%s允许%d个token，本次提问约%d个token，请稍后重试、缩短提问或升级套餐。",
+			packageType, c.description(model), rule.WindowText(), rule.Count, tokens)
+	default:
+		return fmt.Sprintf("超过速率限制：在该%s套餐下，%s每%s允许%d条消息，请稍后重试或升级套餐。",
+			packageType, c.description(model), rule.WindowText(), rule.Count)
+	}
+}
+
+// QuotaInfo 用户在某个模型或共享额度组下的额度使用情况
+type QuotaInfo struct {
+	Product   string         `json:"product"`
+	Package   string         `json:"package"`
+	Model     string         `json:"model,omitempty"`      // 模型名，组和积分计数器为空
+	Group     string         `json:"group,omitempty"`      // 共享额度组名，组计数器才有
+	Unit      string         `json:"unit"`                 // 计量单位: message、token、credit
+	RuleKey   string         `json:"rule_key"`             // 命中的配置项
+	MatchedBy string         `json:"matched_by,omitempty"` // 匹配方式，见 Match* 常量
+	Rule      string         `json:"rule"`
+	Window    string         `json:"window"`
+	Limit     float64        `json:"limit"`
+	Used      float64        `json:"used"`
+	Remaining float64        `json:"remaining"`
+	ResetAt   *time.Time     `json:"reset_at,omitempty"` // 为空表示窗口尚未开始，将从下一次请求开始计时
+	Aligned   bool           `json:"aligned"`
+	Override  *LimitOverride `json:"override,omitempty"` // 生效的用户覆盖
+}
+
+// productScope 返回计数器键中区分产品的部分，旧格式的chatgpt产品为空，保持升级前的键不变
+func productScope(product string) string {
+	if product == legacyProduct {
+		return ""
+	}
+	return product
+}
+
+// counterKey 返回计数器的键，非chatgpt产品的套餐名前加上产品名，对齐窗口按窗口起点分桶
+func counterKey(rule *LimitRule, xuserid, product, packageType, name string, now time.Time) string {
+	if scope := productScope(product); scope != "" {
+		packageType = scope + ":" + packageType
+	}
+	// 限速相关的键都以用户ID作为哈希标签，保证集群模式下位于同一槽位
+	redisKey := keys.RateLimit(xuserid, packageType, name)
+	if bucket := rule.Bucket(now); bucket != "" {
+		redisKey += ":" + bucket
+	}
+	return redisKey
+}
+
+// ruleCounters 为一个配置项中的每条规则创建计数器，token规则按提问的估算token数递增
+func ruleCounters(rules RuleList, override *LimitOverride, name, group, counterName, xuserid, product, packageType string, tokens int, now time.Time) []*limitCounter {
+	counters := make([]*limitCounter, 0, len(rules))
+	for _, rule := range rules {
+		counter := &limitCounter{
+			name:        name,
+			counterName: counterName,
+			group:       group,
+			unit:        rule.Unit,
+			rule:        rule,
+			key:         counterKey(rule, xuserid, product, packageType, counterName, now),
+			increment:   1,
+			override:    override,
+		}
+		if rule.Unit == UnitToken {
+			counter.key = counterKey(rule, xuserid, product, packageType, counterName+tokenCounterSuffix, now)
+			counter.increment = int64(tokens)
+		}
+		counters = append(counters, counter)
+	}
+	return counters
+}
+
+// buildCounters 返回模型命中的规则以及本次请求需要检查的计数器，resolved在未配置任何模型规则时为nil
+//   - 套餐配置了积分额度时，按模型权重扣减积分
+//   - 模型属于共享额度组且套餐配置了该组的规则时检查组计数器
+//   - 套餐为模型单独配置的规则始终检查，作为组内或积分之外的子限额；
+//     other兜底规则只在没有组规则时检查，全局other在配置了积分额度时也不再检查
+//
+// tokens为本次提问的估算token数，用于按token计量的规则；overrides为用户的覆盖，可以为nil
+func buildCounters(product, packageType, model, xuserid string, tokens int, overrides userOverrides, now time.Time) (*ResolvedRule, []*limitCounter) {
+	set := currentLimits()
+	resolved := getLimitRules(product, packageType, model, overrides)
+	canonical := canonicalModel(model)
+	packageRules := set.packageRules(product, packageType)
+
+	var counters []*limitCounter
+	rule, override := creditsRule(product, packageType, overrides)
+	hasCredits := rule != nil
+	if hasCredits {
+		cost := int64(math.Round(set.weights.weight(canonical) * creditScale))
+		if cost > 0 {
+			counters = append(counters, &limitCounter{
+				name:        CreditsRuleKey,
+				counterName: CreditsRuleKey,
+				unit:        UnitCredit,
+				rule:        rule,
+				key:         counterKey(rule, xuserid, product, packageType, CreditsRuleKey, now),
+				increment:   cost,
+				override:    override,
+			})
+		}
+	}
+
+	hasGroup := false
+	if group, exists := set.groupOf[canonical]; exists {
+		var rules RuleList
+		if packageRules != nil {
+			rules = packageRules.groups[group]
+		}
+		rules, override := overrides.apply(rules, GroupRulePrefix+group)
+		if rules != nil {
+			hasGroup = true
+			counters = append(counters, ruleCounters(rules, override, group, group, GroupRulePrefix+group, xuserid, product, packageType, tokens, now)...)
+		}
+	}
+
+	if resolved != nil {
+		useModelRule := resolved.hasOwnRule() ||
+			(resolved.MatchedBy == MatchPackageOther && !hasGroup) ||
+			(resolved.MatchedBy == MatchOther && !hasGroup && !hasCredits)
+		if useModelRule {
+			counters = append(counters, ruleCounters(resolved.Rules, resolved.Override, resolved.RuleKey, "", resolved.counterName(), xuserid, product, packageType, tokens, now)...)
+		}
+	}
+	return resolved, counters
+}
+
+// creditsRule 返回应用用户覆盖后的积分额度规则，未配置积分额度时返回nil
+func creditsRule(product, packageType string, overrides userOverrides) (*LimitRule, *LimitOverride) {
+	var rules RuleList
+	if packageRules := currentLimits().packageRules(product, packageType); packageRules != nil && packageRules.credits != nil {
+		rules = RuleList{packageRules.credits}
+	}
+	rules, override := overrides.apply(rules, CreditsRuleKey)
+	if rules == nil {
+		return nil, nil
+	}
+	return rules[0], override
+}
+
+// consumeCounters 原子地检查并递增计数器，同时记录到用户的计数器索引，返回第一个超限的计数器，全部通过时返回nil并记录每个计数器的过期时间点
+func consumeCounters(xuserid, product, packageType string, counters []*limitCounter, now time.Time) (*limitCounter, error) {
+	redisKeys := make([]string, 0, len(counters)+1)
+	args := make([]interface{}, 0, len(counters)*5+1)
+	redisKeys = append(redisKeys, keys.RateLimitIndex(xuserid))
+	args = append(args, now.UnixMilli())
+	for _, counter := range counters {
+		_, periodEnd := counter.rule.Period(now)
+		entry, err := counter.indexEntry(product, packageType)
+		if err != nil {
+			return nil, err
+		}
+		redisKeys = append(redisKeys, counter.key)
+		args = append(args, counter.max(), counter.increment, periodEnd.UnixMilli(), counter.key, entry)
+	}
+
+	result, err := RedisClient.RunScript(limitScript, redisKeys, args...)
+	if err != nil {
+		return nil, fmt.Errorf("检查速率限制失败: %w", err)
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("限速脚本返回值格式错误: %v", result)
+	}
+	index, ok := values[0].(int64)
+	if !ok || index < 0 || index > int64(len(counters)) {
+		return nil, fmt.Errorf("限速脚本返回值格式错误: %v", result)
+	}
+	if index > 0 {
+		return counters[index-1], nil
+	}
+	if len(values) != len(counters)+1 {
+		return nil, fmt.Errorf("限速脚本返回值格式错误: %v", result)
+	}
+	for i, counter := range counters {
+		if counter.expireAt, ok = values[i+1].(int64); !ok {
+			return nil, fmt.Errorf("限速脚本返回值格式错误: %v", result)
+		}
+	}
+	return nil, nil
+}
+
+// GetStarQuota 查询用户的额度使用情况，不消耗额度
+// 参数: pkg - 用户在查询产品下生效的套餐, model - 模型名称，为空时返回套餐中配置的所有模型和共享额度组
+func GetStarQuota(pkg *UserPackage, model string) ([]QuotaInfo, error) {
+	xuserid, product, packageType := pkg.UserID, pkg.Product, pkg.Level
+
+	now := time.Now()
+	overrides, err := loadOverrides(xuserid, now)
+	if err != nil {
+		return nil, err
+	}
+
+	set := currentLimits()
+	models := []string{model}
+	if model == "" {
+		models = []string{"other"}
+		if packageRules := set.packageRules(product, packageType); packageRules != nil {
+			models = packageRules.names()
+			if packageRules.credits != nil {
+				// 积分额度挂在任意一个消耗积分的模型上
+				models = append(models, CreditsRuleKey)
+			}
+			// 组内没有单独规则的模型也需要列出组计数器
+			for _, group := range sortedKeys(packageRules.groups) {
+				models = append(models, set.data.Groups[group]...)
+			}
+		}
+		// 用户覆盖中单独设置的配置项也需要列出，按模型名前缀属于其他产品的除外
+		for _, key := range sortedKeys(overrides) {
+			if group, ok := strings.CutPrefix(key, GroupRulePrefix); ok {
+				models = append(models, set.data.Groups[group]...)
+			} else if keyProduct, _ := ResolveProduct("", key); key == CreditsRuleKey || keyProduct == product {
+				models = append(models, key)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	quotas := make([]QuotaInfo, 0, len(models))
+	for _, m := range models {
+		resolved, counters := buildCounters(product, packageType, m, xuserid, 0, overrides, now)
+		for _, counter := range counters {
+			if seen[counter.key] {
+				continue
+			}
+			seen[counter.key] = true
+
+			quota, err := counterQuota(counter, now)
+			if err != nil {
+				return nil, err
+			}
+			quota.Product = product
+			quota.Package = packageType
+			switch {
+			case counter.group != "":
+				quota.RuleKey = GroupRulePrefix + counter.group
+			case counter.unit == UnitCredit:
+			default:
+				quota.Model = m
+				quota.MatchedBy = resolved.MatchedBy
+			}
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas, nil
+}
+
+// counterQuota 读取单个计数器的使用情况
+func counterQuota(counter *limitCounter, now time.Time) (QuotaInfo, error) {
+	rule := counter.rule
+	used, err := RedisClient.GetInt(counter.key)
+	if err != nil && err != redis.Nil {
+		return QuotaInfo{}, fmt.Errorf("获取当前计数失败: %w", err)
+	}
+	ttl, err := RedisClient.TTL(counter.key)
+	if err != nil {
+		return QuotaInfo{}, fmt.Errorf("获取计数器过期时间失败: %w", err)
+	}
+
+	scale := float64(counter.scale())
+	quota := QuotaInfo{
+		Group:     counter.group,
+		Unit:      counter.unit,
+		RuleKey:   counter.name,
+		Rule:      rule.Raw,
+		Window:    rule.WindowText(),
+		Limit:     float64(rule.Count),
+		Used:      float64(used) / scale,
+		Remaining: math.Max(0, float64(int64(rule.Count)*counter.scale()-int64(used))/scale),
+		Aligned:   rule.Aligned,
+		Override:  counter.override,
+	}
+	if resetAt, ok := rule.ResetTime(now, ttl); ok && (rule.Aligned || used > 0) {
+		quota.ResetAt = &resetAt
+	}
+	return quota, nil
+}
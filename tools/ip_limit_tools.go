@@ -0,0 +1,101 @@
+package tools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// IP被拒绝的原因，返回给客户端用于区分提示
+const (
+	IPDeniedLocked = "ip_locked" // 认证失败次数过多，IP被锁定
+	IPDeniedRate   = "ip_rate"   // IP的请求数超过上限
+)
+
+// ipRequestScript 检查IP是否被锁定，并在请求数上限内递增当前窗口的请求数
+// KEYS[1] 锁定状态，KEYS[2] 当前窗口的请求数
+// ARGV: 请求数上限（0表示不限制）、窗口毫秒数
+// 返回: {0, 0} 允许，{1, 剩余锁定毫秒数} 已锁定，{2, 窗口剩余毫秒数} 超过请求数上限
+var ipRequestScript = redis.NewScript(`
+local locked = redis.call('PTTL', KEYS[1])
+if locked > 0 then
+	return {1, locked}
+end
+local limit = tonumber(ARGV[1])
+if limit == 0 then
+	return {0, 0}
+end
+local count = redis.call('INCR', KEYS[2])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+if count > limit then
+	return {2, redis.call('PTTL', KEYS[2])}
+end
+return {0, 0}
+`)
+
+// authFailureScript 记录IP的一次认证失败，窗口内失败次数达到上限时锁定IP
+// KEYS[1] 当前窗口的认证失败次数，KEYS[2] 锁定状态
+// ARGV: 失败次数上限、窗口毫秒数、锁定毫秒数
+// 返回: 1 本次失败导致IP被锁定，否则为0
+var authFailureScript = redis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if count >= tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[2], '1', 'PX', ARGV[3])
+	-- 锁定结束后重新计数
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+return 0
+`)
+
+// CheckIPRequest 检查IP能否继续请求，并计入当前窗口的请求数，上限由 ip_limit 配置
+// 返回: (拒绝原因, 需要等待的时间, 错误)，允许时原因为空，否则为 IPDenied* 常量
+func CheckIPRequest(ip string) (string, time.Duration, error) {
+	cfg := config.GetConfig().IPLimit
+	result, err := RedisClient.RunScript(ipRequestScript,
+		[]string{keys.IPLockout(ip), keys.IPRequests(ip)},
+		cfg.Requests, cfg.Window.Milliseconds())
+	if err != nil {
+		return "", 0, fmt.Errorf("检查IP限速失败: %w", err)
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return "", 0, fmt.Errorf("IP限速脚本返回值格式错误: %v", result)
+	}
+	code, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	switch code {
+	case 1:
+		return IPDeniedLocked, time.Duration(wait) * time.Millisecond, nil
+	case 2:
+		return IPDeniedRate, time.Duration(wait) * time.Millisecond, nil
+	}
+	return "", 0, nil
+}
+
+// RecordAuthFailure 记录IP的一次认证失败，返回本次失败是否导致IP被锁定
+// 在 ip_limit.auth_failure_window 内失败 ip_limit.auth_failures 次后，IP被锁定 ip_limit.lockout
+func RecordAuthFailure(ip string) (bool, error) {
+	cfg := config.GetConfig().IPLimit
+	if cfg.AuthFailures == 0 {
+		return false, nil
+	}
+	result, err := RedisClient.RunScript(authFailureScript,
+		[]string{keys.IPAuthFailures(ip), keys.IPLockout(ip)},
+		cfg.AuthFailures, cfg.AuthFailureWindow.Milliseconds(), cfg.Lockout.Milliseconds())
+	if err != nil {
+		return false, fmt.Errorf("记录IP认证失败失败: %w", err)
+	}
+	locked, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("IP认证失败脚本返回值格式错误: %v", result)
+	}
+	return locked == 1, nil
+}
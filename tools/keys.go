@@ -0,0 +1,331 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+
+	"limit_service/config"
+)
+
+// KeySchema Redis键名模板
+// 所有键名都通过这里生成，避免格式散落在各个工具文件中
+type KeySchema struct {
+	hashTags         bool // 集群模式下为多键脚本涉及的键加上哈希标签
+	version          string
+	token            string
+	activePackages   string
+	carStatus        string
+	rateLimit        string
+	rateLimitPackage string
+	limitOverrides   string
+	rateLimitIndex   string
+	adminAudit       string
+	carRPM           string
+	carInflight      string
+	carOutcomes      string
+	carErrors        string
+	carQuarantine    string
+	reservation      string
+	reservations     string
+	userInflight     string
+	userIPs          string
+	userDevices      string
+	userSharing      string
+	ipRequests       string
+	ipAuthFailures   string
+	ipLockout        string
+	sessions         string
+	apiKey           string
+	userAPIKeys      string
+	lease            string
+}
+
+// 全局键名模板，InitRedis时根据配置替换
+var keys = defaultKeySchema()
+
+// NewKeySchema 根据配置创建键名模板，并校验每个模板的参数个数
+// hashTags 为true时（集群模式）用户ID、车ID等标识包装为哈希标签，否则键名与模板完全一致
+func NewKeySchema(cfg config.KeyConfig, hashTags bool) (*KeySchema, error) {
+	templates := []struct {
+		name     string
+		template string
+		args     int
+	}{
+		{"Token", cfg.Token, 1},
+		{"ActivePackages", cfg.ActivePackages, 1},
+		{"CarStatus", cfg.CarStatus, 1},
+		{"RateLimit", cfg.RateLimit, 3},
+		{"RateLimitPackage", cfg.RateLimitPackage, 1},
+		{"LimitOverrides", cfg.LimitOverrides, 1},
+		{"RateLimitIndex", cfg.RateLimitIndex, 1},
+		{"AdminAudit", cfg.AdminAudit, 0},
+		{"CarRPM", cfg.CarRPM, 1},
+		{"CarInflight", cfg.CarInflight, 1},
+		{"CarOutcomes", cfg.CarOutcomes, 1},
+		{"CarErrors", cfg.CarErrors, 1},
+		{"CarQuarantine", cfg.CarQuarantine, 1},
+		{"Reservation", cfg.Reservation, 2},
+		{"Reservations", cfg.Reservations, 0},
+		{"UserInflight", cfg.UserInflight, 1},
+		{"UserIPs", cfg.UserIPs, 1},
+		{"UserDevices", cfg.UserDevices, 1},
+		{"UserSharing", cfg.UserSharing, 1},
+		{"IPRequests", cfg.IPRequests, 1},
+		{"IPAuthFailures", cfg.IPAuthFailures, 1},
+		{"IPLockout", cfg.IPLockout, 1},
+		{"Sessions", cfg.Sessions, 1},
+		{"APIKey", cfg.APIKey, 1},
+		{"UserAPIKeys", cfg.UserAPIKeys, 1},
+		{"Lease", cfg.Lease, 1},
+	}
+
+	var errs []string
+	for _, t := range templates {
+		if err := checkKeyTemplate(t.template, t.args); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t.name, err))
+		}
+	}
+	// 前缀和版本号中出现花括号会破坏用户ID的哈希标签
+	if strings.ContainsAny(cfg.Prefix, "{}") {
+		errs = append(errs, "Prefix: 不能包含花括号")
+	}
+	if strings.ContainsAny(cfg.Version, "{}") {
+		errs = append(errs, "Version: 不能包含花括号")
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("键名模板配置错误: %s", strings.Join(errs, "; "))
+	}
+
+	return &KeySchema{
+		hashTags:         hashTags,
+		version:          cfg.Version,
+		token:            cfg.Token,
+		activePackages:   cfg.ActivePackages,
+		carStatus:        cfg.CarStatus,
+		rateLimit:        cfg.RateLimit,
+		rateLimitPackage: cfg.RateLimitPackage,
+		limitOverrides:   cfg.LimitOverrides,
+		rateLimitIndex:   cfg.RateLimitIndex,
+		adminAudit:       cfg.AdminAudit,
+		carRPM:           cfg.CarRPM,
+		carInflight:      cfg.CarInflight,
+		carOutcomes:      cfg.CarOutcomes,
+		carErrors:        cfg.CarErrors,
+		carQuarantine:    cfg.CarQuarantine,
+		reservation:      cfg.Reservation,
+		reservations:     cfg.Reservations,
+		userInflight:     cfg.UserInflight,
+		userIPs:          cfg.UserIPs,
+		userDevices:      cfg.UserDevices,
+		userSharing:      cfg.UserSharing,
+		ipRequests:       cfg.IPRequests,
+		ipAuthFailures:   cfg.IPAuthFailures,
+		ipLockout:        cfg.IPLockout,
+		sessions:         cfg.Sessions,
+		apiKey:           cfg.APIKey,
+		userAPIKeys:      cfg.UserAPIKeys,
+		lease:            cfg.Lease,
+	}, nil
+}
+
+// defaultKeySchema 使用内置默认配置创建键名模板
+func defaultKeySchema() *KeySchema {
+	schema, err := NewKeySchema(config.Default().Keys, false)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
+
+// checkKeyTemplate 校验模板中只包含指定个数的 %s 占位符
+func checkKeyTemplate(template string, args int) error {
+	if template == "" {
+		return fmt.Errorf("模板为空")
+	}
+	if n := strings.Count(template, "%s"); n != args {
+		return fmt.Errorf("模板 %q 需要 %d 个 %%s 占位符，实际为 %d 个", template, args, n)
+	}
+	if strings.Count(template, "%") != args {
+		return fmt.Errorf("模板 %q 只能使用 %%s 占位符", template)
+	}
+	return nil
+}
+
+// tag 集群模式下将标识包装为哈希标签，同一用户或同一辆车的键落在同一槽位；单机和哨兵模式下原样返回
+func (k *KeySchema) tag(id string) string {
+	if !k.hashTags {
+		return id
+	}
+	return HashTag(id)
+}
+
+// owned 为本服务自有的键加上版本号
+func (k *KeySchema) owned(key string) string {
+	if k.version == "" {
+		return key
+	}
+	return k.version + ":" + key
+}
+
+// Token 用户token的键
+func (k *KeySchema) Token(xuserid string) string {
+	return fmt.Sprintf(k.token, xuserid)
+}
+
+// ActivePackages 用户激活套餐的键
+func (k *KeySchema) ActivePackages(xuserid string) string {
+	return fmt.Sprintf(k.activePackages, xuserid)
+}
+
+// CarStatus 车状态的键
+func (k *KeySchema) CarStatus(carid string) string {
+	return fmt.Sprintf(k.carStatus, carid)
+}
+
+// CarStatusPattern 匹配所有车状态键的SCAN模式
+func (k *KeySchema) CarStatusPattern() string {
+	before, after, _ := strings.Cut(k.carStatus, "%s")
+	return globEscape(before) + "*" + globEscape(after)
+}
+
+// CarIDFromStatusKey 从车状态键中取出车ID，键不符合模板时返回false
+func (k *KeySchema) CarIDFromStatusKey(key string) (string, bool) {
+	before, after, _ := strings.Cut(k.carStatus, "%s")
+	if !strings.HasPrefix(key, before) || !strings.HasSuffix(key, after) || len(key) <= len(before)+len(after) {
+		return "", false
+	}
+	return key[len(before) : len(key)-len(after)], true
+}
+
+// globEscape 转义SCAN模式中的通配符
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RateLimit 限速计数器的键，集群模式下用户ID作为哈希标签
+// 与主应用共享，不插入版本号
+func (k *KeySchema) RateLimit(xuserid, packageType, model string) string {
+	return fmt.Sprintf(k.rateLimit, k.tag(xuserid), packageType, model)
+}
+
+// RateLimitPackage 用户上次使用套餐的键，集群模式下用户ID作为哈希标签
+// 与主应用共享，不插入版本号；每个产品单独记录，scope为空时（旧格式的chatgpt产品）单机和哨兵模式下与升级前的键相同
+func (k *KeySchema) RateLimitPackage(xuserid, scope string) string {
+	key := fmt.Sprintf(k.rateLimitPackage, k.tag(xuserid))
+	if scope != "" {
+		key += ":" + scope
+	}
+	return key
+}
+
+// RateLimitIndex 用户所有计数器的索引键，与计数器位于同一哈希槽
+func (k *KeySchema) RateLimitIndex(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.rateLimitIndex, k.tag(xuserid)))
+}
+
+// LimitOverrides 用户限速覆盖的键，用户ID作为哈希标签
+func (k *KeySchema) LimitOverrides(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.limitOverrides, k.tag(xuserid)))
+}
+
+// AdminAudit 管理操作审计日志的键
+func (k *KeySchema) AdminAudit() string {
+	return k.owned(k.adminAudit)
+}
+
+// CarRPM 车最近一分钟请求记录的键，车ID作为哈希标签
+func (k *KeySchema) CarRPM(carid string) string {
+	return k.owned(fmt.Sprintf(k.carRPM, k.tag(carid)))
+}
+
+// CarInflight 车正在处理的请求的键，车ID作为哈希标签，与 CarRPM 位于同一槽位
+func (k *KeySchema) CarInflight(carid string) string {
+	return k.owned(fmt.Sprintf(k.carInflight, k.tag(carid)))
+}
+
+// CarOutcomes 车最近上游请求结果的键，车ID作为哈希标签
+func (k *KeySchema) CarOutcomes(carid string) string {
+	return k.owned(fmt.Sprintf(k.carOutcomes, k.tag(carid)))
+}
+
+// CarErrors 车最近上游错误的键，车ID作为哈希标签
+func (k *KeySchema) CarErrors(carid string) string {
+	return k.owned(fmt.Sprintf(k.carErrors, k.tag(carid)))
+}
+
+// CarQuarantine 车隔离状态的键，车ID作为哈希标签
+func (k *KeySchema) CarQuarantine(carid string) string {
+	return k.owned(fmt.Sprintf(k.carQuarantine, k.tag(carid)))
+}
+
+// Reservation 额度预留的键，用户ID作为哈希标签，与用户的计数器位于同一槽位
+func (k *KeySchema) Reservation(xuserid, id string) string {
+	return k.owned(fmt.Sprintf(k.reservation, k.tag(xuserid), id))
+}
+
+// Reservations 所有未确认的额度预留的键
+func (k *KeySchema) Reservations() string {
+	return k.owned(k.reservations)
+}
+
+// UserInflight 用户正在处理的请求的键，用户ID作为哈希标签
+func (k *KeySchema) UserInflight(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.userInflight, k.tag(xuserid)))
+}
+
+// UserIPs 用户最近使用的IP的键，用户ID作为哈希标签
+func (k *KeySchema) UserIPs(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.userIPs, k.tag(xuserid)))
+}
+
+// UserDevices 用户最近使用的设备的键，用户ID作为哈希标签
+func (k *KeySchema) UserDevices(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.userDevices, k.tag(xuserid)))
+}
+
+// UserSharing 用户超过账号共享检测上限的记录的键，用户ID作为哈希标签
+func (k *KeySchema) UserSharing(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.userSharing, k.tag(xuserid)))
+}
+
+// IPRequests IP在当前窗口的请求数的键，IP作为哈希标签
+func (k *KeySchema) IPRequests(ip string) string {
+	return k.owned(fmt.Sprintf(k.ipRequests, k.tag(ip)))
+}
+
+// IPAuthFailures IP在当前窗口的认证失败次数的键，IP作为哈希标签，与锁定状态位于同一槽位
+func (k *KeySchema) IPAuthFailures(ip string) string {
+	return k.owned(fmt.Sprintf(k.ipAuthFailures, k.tag(ip)))
+}
+
+// IPLockout IP的锁定状态的键，IP作为哈希标签
+func (k *KeySchema) IPLockout(ip string) string {
+	return k.owned(fmt.Sprintf(k.ipLockout, k.tag(ip)))
+}
+
+// Sessions 用户所有会话token的键，用户ID作为哈希标签
+func (k *KeySchema) Sessions(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.sessions, k.tag(xuserid)))
+}
+
+// APIKey API key对应的用户的键，参数为API key的SHA-256，作为哈希标签
+func (k *KeySchema) APIKey(keyHash string) string {
+	return k.owned(fmt.Sprintf(k.apiKey, k.tag(keyHash)))
+}
+
+// UserAPIKeys 用户所有API key的键，用户ID作为哈希标签
+func (k *KeySchema) UserAPIKeys(xuserid string) string {
+	return k.owned(fmt.Sprintf(k.userAPIKeys, k.tag(xuserid)))
+}
+
+// Lease 通过审核的请求占用的名额和预留的键，参数为名额ID
+func (k *KeySchema) Lease(leaseID string) string {
+	return k.owned(fmt.Sprintf(k.lease, leaseID))
+}
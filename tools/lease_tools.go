@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// RequestLease 一次通过审核的请求占用的用户和车并发名额以及额度预留
+// 完成回调只提交名额ID，释放哪个用户、哪辆车的名额以及确认或退还哪个预留都以这里的记录为准
+type RequestLease struct {
+	ID            string    `json:"-"`
+	UserID        string    `json:"user_id"`
+	CarID         string    `json:"car_id,omitempty"`
+	ReservationID string    `json:"reservation_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// leaseTTL 请求记录的保存时间，不短于名额和预留的超时时间，之后名额和预留都已经自动处理
+func leaseTTL() time.Duration {
+	policies := config.GetConfig().Policies
+	ttl := policies.UserLeaseTimeout
+	if policies.CarLeaseTimeout > ttl {
+		ttl = policies.CarLeaseTimeout
+	}
+	if policies.ReservationTimeout > ttl {
+		ttl = policies.ReservationTimeout
+	}
+	return ttl
+}
+
+// SaveRequestLease 保存请求占用的名额和预留，ID为空时（用户和车都没有并发上限）生成新的ID
+func SaveRequestLease(lease *RequestLease) error {
+	if lease.ID == "" {
+		id, err := randomID()
+		if err != nil {
+			return err
+		}
+		lease.ID = id
+	}
+	if err := RedisClient.Set(keys.Lease(lease.ID), lease, leaseTTL()); err != nil {
+		return fmt.Errorf("保存请求记录失败: %w", err)
+	}
+	return nil
+}
+
+// GetRequestLease 获取请求占用的名额和预留，记录不存在（已完成或已过期）时返回nil
+func GetRequestLease(leaseID string) (*RequestLease, error) {
+	value, err := RedisClient.GetString(keys.Lease(leaseID))
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("获取请求记录失败: %w", err)
+	}
+	var lease RequestLease
+	if err := json.Unmarshal([]byte(value), &lease); err != nil {
+		return nil, fmt.Errorf("解析请求记录失败: %w", err)
+	}
+	lease.ID = leaseID
+	return &lease, nil
+}
+
+// DeleteRequestLease 删除已经完成的请求记录
+func DeleteRequestLease(leaseID string) error {
+	if err := RedisClient.Delete(keys.Lease(leaseID)); err != nil {
+		return fmt.Errorf("删除请求记录失败: %w", err)
+	}
+	return nil
+}
@@ -3,177 +3,622 @@ package tools
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
-	"strconv"
+	"path"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
 )
 
 // LimitData 限速配置数据结构
+// products 中每个产品（ChatGPT、Claude等后端）有自己的套餐规则，套餐中的模型名可以是精确名称，
+// 也可以是 "gpt-4o*"、"o1-*" 这样的通配模式；"group:组名" 为共享额度组的规则，组内模型共用一个计数器；
+// "credits" 为按模型权重扣减的积分额度。别名、共享额度组、权重和other对所有产品生效
 type LimitData struct {
-	ChatGPT map[string]map[string]string `json:"chatgpt"`
-	Other   string                       `json:"other"`
+	Products map[string]*ProductData      `json:"products"`
+	ChatGPT  map[string]map[string]string `json:"chatgpt"` // 旧格式，等同于 products.chatgpt.packages
+	Aliases  map[string]string            `json:"aliases"` // 模型别名 -> 规则中使用的模型名
+	Groups   map[string][]string          `json:"groups"`  // 共享额度组 -> 组内模型
+	Weights  map[string]float64           `json:"weights"` // 模型 -> 每条消息消耗的积分，默认为1
+	Other    string                       `json:"other"`
+
+	CarAccess *CarAccessData           `json:"car_access"` // 车权限矩阵，未配置时使用内置的默认规则
+	CarLimits map[string]*CarLimitData `json:"car_limits"` // 车标签 -> 默认的负载上限，"*" 为其他标签的上限
+
+	UserConcurrency map[string]int          `json:"user_concurrency"` // 套餐等级 -> 用户同时处理的请求数上限，"*" 为其他等级的上限
+	Sharing         map[string]*SharingRule `json:"sharing"`          // 套餐等级 -> 账号共享检测的上限，"*" 为其他等级的上限
+}
+
+// ProductData 单个产品的限速配置
+type ProductData struct {
+	PackageKey    string                       `json:"package_key"`    // 用户激活套餐中该产品的键，如 "ChatGPT"，默认为产品名
+	ModelPrefixes []string                     `json:"model_prefixes"` // 请求未指定产品时按模型名前缀选择产品，如 ["claude-"]
+	Packages      map[string]map[string]string `json:"packages"`       // 套餐 -> 模型 -> 规则
+}
+
+// legacyProduct 旧格式中唯一的产品，其计数器键保持不加产品名，升级后已有的计数不会丢失
+const (
+	legacyProduct    = "chatgpt"
+	legacyPackageKey = "ChatGPT"
+)
+
+// GroupRulePrefix 套餐中共享额度组规则的前缀
+const GroupRulePrefix = "group:"
+
+// CreditsRuleKey 套餐中积分额度规则的名称，如 "credits": "1000/1d" 表示每天1000积分
+const CreditsRuleKey = "credits"
+
+// 规则的匹配方式
+const (
+	MatchExact        = "exact"         // 精确匹配
+	MatchPattern      = "pattern"       // 通配模式匹配
+	MatchPackageOther = "package_other" // 套餐内的other规则
+	MatchOther        = "other"         // 全局兜底规则
+	MatchOverride     = "override"      // 用户覆盖中为模型配置的绝对规则
+)
+
+// ResolvedRule 模型解析后命中的规则，用于限速和调试
+type ResolvedRule struct {
+	Product   string         `json:"product"`
+	Package   string         `json:"package"`
+	Model     string         `json:"model"`      // 请求中的模型名
+	Canonical string         `json:"canonical"`  // 别名解析后的模型名
+	MatchedBy string         `json:"matched_by"` // 匹配方式
+	RuleKey   string         `json:"rule_key"`   // 命中的配置项，如 "gpt-4o*"
+	Rules     RuleList       `json:"-"`
+	RuleText  string         `json:"rule"`
+	Override  *LimitOverride `json:"override,omitempty"` // 生效的用户覆盖
+}
+
+// counterName 计数器使用的模型名：通配模式命中的模型共用同一个计数器
+func (r *ResolvedRule) counterName() string {
+	if r.MatchedBy == MatchPattern {
+		return r.RuleKey
+	}
+	return r.Canonical
+}
+
+// patternEntry 通配模式配置项
+type patternEntry[V any] struct {
+	pattern string
+	prefix  string // 第一个通配符之前的字面前缀，越长优先级越高
+	value   V
 }
 
-// 全局限速数据
-var limitData LimitData
+// newPatternEntry 校验通配模式并创建配置项
+func newPatternEntry[V any](pattern string, value V) (patternEntry[V], error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return patternEntry[V]{}, fmt.Errorf("通配模式错误: %w", err)
+	}
+	return patternEntry[V]{
+		pattern: pattern,
+		prefix:  pattern[:strings.IndexAny(pattern, "*?[")],
+		value:   value,
+	}, nil
+}
+
+// matchPattern 返回第一个匹配的通配模式，patterns需已按优先级排序
+func matchPattern[V any](patterns []patternEntry[V], model string) (patternEntry[V], bool) {
+	for _, entry := range patterns {
+		if ok, _ := path.Match(entry.pattern, model); ok {
+			return entry, true
+		}
+	}
+	return patternEntry[V]{}, false
+}
+
+// packageRules 单个套餐的规则
+type packageRules struct {
+	exact    map[string]RuleList
+	patterns []patternEntry[RuleList] // 已按优先级排序
+	groups   map[string]RuleList      // 共享额度组 -> 规则
+	credits  *LimitRule               // 积分额度，未配置时为nil
+}
+
+// weightTable 模型的积分消耗权重
+type weightTable struct {
+	exact    map[string]float64
+	patterns []patternEntry[float64] // 已按优先级排序
+}
+
+// weight 返回模型每条消息消耗的积分，按 精确匹配 > 最长前缀的通配模式 > other 查找，默认为1
+func (w *weightTable) weight(model string) float64 {
+	if weight, exists := w.exact[model]; exists {
+		return weight
+	}
+	if entry, ok := matchPattern(w.patterns, model); ok {
+		return entry.value
+	}
+	if weight, exists := w.exact["other"]; exists {
+		return weight
+	}
+	return 1
+}
+
+// match 按 精确匹配 > 最长前缀的通配模式 > other 的顺序查找规则
+func (p *packageRules) match(model string) (string, string, RuleList) {
+	if rule, exists := p.exact[model]; exists && model != "other" {
+		return MatchExact, model, rule
+	}
+	if entry, ok := matchPattern(p.patterns, model); ok {
+		return MatchPattern, entry.pattern, entry.value
+	}
+	if rule, exists := p.exact["other"]; exists {
+		return MatchPackageOther, "other", rule
+	}
+	return "", "", nil
+}
+
+// names 返回套餐中配置的所有模型规则名
+func (p *packageRules) names() []string {
+	names := sortedKeys(p.exact)
+	for _, entry := range p.patterns {
+		names = append(names, entry.pattern)
+	}
+	return names
+}
+
+// hasOwnRule 判断是否为套餐中为模型单独配置的规则（而不是other兜底）
+func (r *ResolvedRule) hasOwnRule() bool {
+	return r.MatchedBy == MatchExact || r.MatchedBy == MatchPattern || r.MatchedBy == MatchOverride
+}
+
+// productRules 单个产品加载后的规则
+type productRules struct {
+	name       string
+	packageKey string
+	packages   map[string]*packageRules // 套餐 -> 规则
+}
+
+// limitSet 加载后的限速配置，规则在加载时解析并缓存
+type limitSet struct {
+	data     LimitData
+	products map[string]*productRules // 产品 -> 规则
+	prefixes []productPrefix          // 模型名前缀 -> 产品，按前缀长度从长到短排序
+	aliases  map[string]string
+	groupOf  map[string]string // 模型 -> 所属的共享额度组
+	weights  weightTable
+	other    RuleList // 兜底规则，未配置时为nil
+
+	carAccess *carAccessPolicy
+	carLimits map[string]CarLimitData
+
+	userConcurrency map[string]int
+	sharing         map[string]SharingRule
+}
+
+// productPrefix 按模型名前缀选择产品
+type productPrefix struct {
+	prefix  string
+	product string
+}
+
+// hasPackage 判断产品中是否配置了指定套餐
+func (s *limitSet) hasPackage(product, packageType string) bool {
+	return s.packageRules(product, packageType) != nil
+}
+
+// packageRules 返回产品中指定套餐的规则，未配置时返回nil
+func (s *limitSet) packageRules(product, packageType string) *packageRules {
+	if rules, exists := s.products[product]; exists {
+		return rules.packages[packageType]
+	}
+	return nil
+}
+
+// 全局限速数据，重新加载时整体替换，读取时通过 currentLimits 获取
+var (
+	limitsMu sync.RWMutex
+	limits   = &limitSet{}
+)
+
+// currentLimits 返回当前生效的限速配置
+func currentLimits() *limitSet {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return limits
+}
 
 // InitStarLimit 初始化限速数据
 func InitStarLimit() error {
+	return LoadStarLimit(config.GetConfig().Paths.Limit)
+}
+
+// LoadStarLimit 读取并校验限速配置文件，所有规则都合法时才替换当前配置
+func LoadStarLimit(path string) error {
 	// 读取限速配置文件
-	file, err := os.Open("./data/limit.json")
+	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("打开限速配置文件失败: %w", err)
 	}
 	defer file.Close()
 
-	if err := json.NewDecoder(file).Decode(&limitData); err != nil {
+	var data LimitData
+	if err := json.NewDecoder(file).Decode(&data); err != nil {
 		return fmt.Errorf("解析限速配置文件失败: %w", err)
 	}
 
+	set, err := buildLimitSet(data)
+	if err != nil {
+		return err
+	}
+	limitsMu.Lock()
+	limits = set
+	limitsMu.Unlock()
+
 	fmt.Println("限速配置初始化完成")
 	return nil
 }
 
-// parseLimit 解析限制配置，将 '次数/时间' 解析为计数和时间（秒）
-func parseLimit(limitStr string) (int, int, error) {
-	parts := strings.Split(limitStr, "/")
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("限制格式错误: %s", limitStr)
+// buildLimitSet 解析所有规则，返回包含全部错误路径的汇总错误
+func buildLimitSet(data LimitData) (*limitSet, error) {
+	set := &limitSet{
+		data:    data,
+		aliases: make(map[string]string, len(data.Aliases)),
+		groupOf: make(map[string]string),
 	}
+	var errs []string
 
-	count, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, 0, fmt.Errorf("次数解析错误: %w", err)
+	for _, group := range sortedKeys(data.Groups) {
+		members := data.Groups[group]
+		if group == "" || len(members) == 0 {
+			errs = append(errs, fmt.Sprintf("groups.%s: 组名和组内模型不能为空", group))
+			continue
+		}
+		for _, model := range members {
+			if other, exists := set.groupOf[model]; exists {
+				errs = append(errs, fmt.Sprintf("groups.%s: 模型 %s 已属于组 %s，一个模型只能属于一个组", group, model, other))
+				continue
+			}
+			set.groupOf[model] = group
+		}
 	}
 
-	duration := parts[1]
-	var seconds int
+	products := data.Products
+	if data.ChatGPT != nil {
+		if _, exists := products[legacyProduct]; exists {
+			errs = append(errs, fmt.Sprintf("chatgpt: 与 products.%s 重复，请只保留一种格式", legacyProduct))
+		} else {
+			products = make(map[string]*ProductData, len(data.Products)+1)
+			for name, product := range data.Products {
+				products[name] = product
+			}
+			products[legacyProduct] = &ProductData{PackageKey: legacyPackageKey, Packages: data.ChatGPT}
+		}
+	}
+
+	set.products = make(map[string]*productRules, len(products))
+	prefixOwner := make(map[string]string)
+	for _, name := range sortedKeys(products) {
+		product := products[name]
+		// 产品名与请求中的产品比较时统一为小写
+		productName := strings.ToLower(name)
+		pathPrefix := "products." + name + ".packages"
+		if name == legacyProduct && data.ChatGPT != nil {
+			pathPrefix = "chatgpt"
+		}
+		if product == nil {
+			errs = append(errs, fmt.Sprintf("products.%s: 产品配置不能为空", name))
+			continue
+		}
+		if _, exists := set.products[productName]; exists {
+			errs = append(errs, fmt.Sprintf("products.%s: 产品名重复（不区分大小写）", name))
+			continue
+		}
+
+		rules := &productRules{
+			name:       productName,
+			packageKey: product.PackageKey,
+			packages:   make(map[string]*packageRules, len(product.Packages)),
+		}
+		if rules.packageKey == "" {
+			rules.packageKey = name
+		}
+		for _, prefix := range product.ModelPrefixes {
+			if prefix == "" {
+				errs = append(errs, fmt.Sprintf("products.%s.model_prefixes: 前缀不能为空", name))
+				continue
+			}
+			if owner, exists := prefixOwner[prefix]; exists {
+				errs = append(errs, fmt.Sprintf("products.%s.model_prefixes: 前缀 %q 已属于产品 %s", name, prefix, owner))
+				continue
+			}
+			prefixOwner[prefix] = name
+			set.prefixes = append(set.prefixes, productPrefix{prefix: prefix, product: productName})
+		}
+		for _, packageType := range sortedKeys(product.Packages) {
+			packageRules, packageErrs := buildPackageRules(product.Packages[packageType], data.Groups, pathPrefix+"."+packageType)
+			errs = append(errs, packageErrs...)
+			// 套餐名与Redis中的等级比较时统一为小写
+			rules.packages[strings.ToLower(packageType)] = packageRules
+		}
+		set.products[productName] = rules
+	}
+	sort.Slice(set.prefixes, func(i, j int) bool {
+		if len(set.prefixes[i].prefix) != len(set.prefixes[j].prefix) {
+			return len(set.prefixes[i].prefix) > len(set.prefixes[j].prefix)
+		}
+		return set.prefixes[i].prefix < set.prefixes[j].prefix
+	})
+
+	for _, alias := range sortedKeys(data.Aliases) {
+		target := data.Aliases[alias]
+		switch {
+		case isModelPattern(alias):
+			errs = append(errs, fmt.Sprintf("aliases.%s: 别名不能使用通配符", alias))
+		case target == "" || target == alias:
+			errs = append(errs, fmt.Sprintf("aliases.%s: 别名目标无效: %q", alias, target))
+		case data.Aliases[target] != "":
+			errs = append(errs, fmt.Sprintf("aliases.%s: 别名目标 %q 本身也是别名，不支持链式别名", alias, target))
+		default:
+			set.aliases[alias] = target
+		}
+	}
 
-	if strings.HasSuffix(duration, "h") {
-		hours, err := strconv.Atoi(strings.TrimSuffix(duration, "h"))
+	set.weights.exact = make(map[string]float64, len(data.Weights))
+	for _, model := range sortedKeys(data.Weights) {
+		weight := data.Weights[model]
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			errs = append(errs, fmt.Sprintf("weights.%s: 权重必须是非负数，当前为 %v", model, weight))
+			continue
+		}
+		if !isModelPattern(model) {
+			set.weights.exact[model] = weight
+			continue
+		}
+		entry, err := newPatternEntry(model, weight)
 		if err != nil {
-			return 0, 0, fmt.Errorf("小时解析错误: %w", err)
+			errs = append(errs, fmt.Sprintf("weights.%s: %v", model, err))
+			continue
 		}
-		seconds = hours * 3600
-	} else if strings.HasSuffix(duration, "d") {
-		days, err := strconv.Atoi(strings.TrimSuffix(duration, "d"))
+		set.weights.patterns = append(set.weights.patterns, entry)
+	}
+	sortPatterns(set.weights.patterns)
+
+	if data.Other != "" {
+		rule, err := ParseRuleList(data.Other)
 		if err != nil {
-			return 0, 0, fmt.Errorf("天数解析错误: %w", err)
+			errs = append(errs, fmt.Sprintf("other: %v", err))
 		}
-		seconds = days * 86400
-	} else if strings.HasSuffix(duration, "m") {
-		minutes, err := strconv.Atoi(strings.TrimSuffix(duration, "m"))
+		set.other = rule
+	}
+
+	carAccess, carErrs := buildCarAccess(data.CarAccess)
+	errs = append(errs, carErrs...)
+	set.carAccess = carAccess
+	carLimits, carErrs := buildCarLimits(data.CarLimits)
+	errs = append(errs, carErrs...)
+	set.carLimits = carLimits
+	userConcurrency, concurrencyErrs := buildUserConcurrency(data.UserConcurrency)
+	errs = append(errs, concurrencyErrs...)
+	set.userConcurrency = userConcurrency
+	sharing, sharingErrs := buildSharingRules(data.Sharing)
+	errs = append(errs, sharingErrs...)
+	set.sharing = sharing
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("限速配置校验失败:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return set, nil
+}
+
+// buildPackageRules 解析一个套餐中的所有规则，path为错误信息中套餐的路径
+func buildPackageRules(models map[string]string, groups map[string][]string, path string) (*packageRules, []string) {
+	var errs []string
+	rules := &packageRules{
+		exact:  make(map[string]RuleList, len(models)),
+		groups: make(map[string]RuleList),
+	}
+	for _, model := range sortedKeys(models) {
+		rule, err := ParseRuleList(models[model])
 		if err != nil {
-			return 0, 0, fmt.Errorf("分钟解析错误: %w", err)
+			errs = append(errs, fmt.Sprintf("%s.%s: %v", path, model, err))
+			continue
+		}
+		if group, ok := strings.CutPrefix(model, GroupRulePrefix); ok {
+			if _, exists := groups[group]; !exists {
+				errs = append(errs, fmt.Sprintf("%s.%s: 未定义的共享额度组 %s", path, model, group))
+				continue
+			}
+			rules.groups[group] = rule
+			continue
 		}
-		seconds = minutes * 60
-	} else {
-		var err error
-		seconds, err = strconv.Atoi(duration)
+		if model == CreditsRuleKey {
+			if len(rule) != 1 || rule[0].Unit != UnitMessage {
+				errs = append(errs, fmt.Sprintf("%s.%s: 积分额度只能配置一条 '积分/时长' 规则", path, model))
+				continue
+			}
+			rules.credits = rule[0]
+			continue
+		}
+		if !isModelPattern(model) {
+			rules.exact[model] = rule
+			continue
+		}
+		entry, err := newPatternEntry(model, rule)
 		if err != nil {
-			return 0, 0, fmt.Errorf("秒数解析错误: %w", err)
+			errs = append(errs, fmt.Sprintf("%s.%s: %v", path, model, err))
+			continue
 		}
+		rules.patterns = append(rules.patterns, entry)
 	}
+	sortPatterns(rules.patterns)
+	return rules, errs
+}
 
-	return count, seconds, nil
+// isModelPattern 判断模型名是否为通配模式
+func isModelPattern(model string) bool {
+	return strings.ContainsAny(model, "*?[")
 }
 
-// getLimitRules 按顺序查找限制规则
-func getLimitRules(packageType, model string) string {
-	if chatgptRules, exists := limitData.ChatGPT[packageType]; exists {
-		if limit, exists := chatgptRules[model]; exists {
-			return limit
+// sortPatterns 按字面前缀长度降序排列通配模式，前缀相同时按模式本身排序，保证匹配结果确定
+func sortPatterns[V any](patterns []patternEntry[V]) {
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i].prefix) != len(patterns[j].prefix) {
+			return len(patterns[i].prefix) > len(patterns[j].prefix)
 		}
-		if limit, exists := chatgptRules["other"]; exists {
-			return limit
+		if len(patterns[i].pattern) != len(patterns[j].pattern) {
+			return len(patterns[i].pattern) > len(patterns[j].pattern)
 		}
+		return patterns[i].pattern < patterns[j].pattern
+	})
+}
+
+// sortedKeys 返回排序后的键，保证错误信息顺序稳定
+func sortedKeys[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
 	}
-	return limitData.Other
+	sort.Strings(names)
+	return names
 }
 
-// GetStarLimit 检查用户在指定模型下的速率限制，并返回是否允许发送消息
-// 参数: xuserid - 用户ID, model - 模型名称
-// 返回: (是否允许发送消息, 消息内容, 错误)
-func GetStarLimit(xuserid, model string) (bool, string, error) {
-	// 获取用户当前激活的套餐信息
-	activePackagesKey := fmt.Sprintf("user:%s:active_packages", xuserid)
-	activePackagesData, err := RedisClient.Get(activePackagesKey)
-	if err != nil {
-		return false, "", fmt.Errorf("获取用户套餐信息失败: %w", err)
-	}
-
-	packageType := "free" // 默认为免费套餐
-	if activePackagesData != nil {
-		userData, ok := activePackagesData.(map[string]interface{})
-		if ok {
-			if chatgptData, exists := userData["ChatGPT"]; exists {
-				if chatgptMap, ok := chatgptData.(map[string]interface{}); ok {
-					if level, exists := chatgptMap["level"]; exists {
-						if levelStr, ok := level.(string); ok {
-							packageType = strings.ToLower(levelStr)
-						}
-					}
-				}
-			}
+// ResolveLimitRule 解析产品、套餐和模型命中的限速规则，未配置任何规则时返回nil
+func ResolveLimitRule(product, packageType, model string) *ResolvedRule {
+	return getLimitRules(product, packageType, model, nil)
+}
+
+// ResolveProduct 确定请求使用的产品：优先使用请求中指定的产品（路径或header），
+// 其次按模型名前缀匹配，都没有时使用配置的默认产品
+func ResolveProduct(requested, model string) (string, error) {
+	set := currentLimits()
+	if requested != "" {
+		product := strings.ToLower(requested)
+		if _, exists := set.products[product]; !exists {
+			return "", fmt.Errorf("未知的产品: %s", requested)
 		}
+		return product, nil
 	}
 
-	// 获取速率限制规则
-	limitStr := getLimitRules(packageType, model)
-	if limitStr == "" {
-		return false, "未配置速率限制", nil
+	canonical := canonicalModel(model)
+	for _, entry := range set.prefixes {
+		if strings.HasPrefix(model, entry.prefix) || strings.HasPrefix(canonical, entry.prefix) {
+			return entry.product, nil
+		}
 	}
+	return strings.ToLower(config.GetConfig().Policies.DefaultProduct), nil
+}
 
-	// 解析速率限制规则
-	maxCount, windowSeconds, err := parseLimit(limitStr)
-	if err != nil {
-		return false, "", fmt.Errorf("解析限制规则失败: %w", err)
+// canonicalModel 返回别名解析后的模型名
+func canonicalModel(model string) string {
+	if target, exists := currentLimits().aliases[model]; exists {
+		return target
 	}
+	return model
+}
 
-	redisKey := fmt.Sprintf("star_rate_limit:%s:%s:%s", xuserid, packageType, model)
-	userPackageKey := fmt.Sprintf("star_rate_limit_package:%s", xuserid)
-
-	// 检查用户当前套餐是否发生变化
-	storedPackage, err := RedisClient.GetString(userPackageKey)
-	if err != nil && err.Error() != "redis: nil" {
-		return false, "", fmt.Errorf("获取存储的套餐信息失败: %w", err)
+// getLimitRules 按 别名 -> 精确匹配 -> 最长前缀通配 -> 套餐other -> 全局other 的顺序查找限制规则，
+// 找到后再应用用户的覆盖：依次查找以模型名、命中的配置项和 "*" 为键的覆盖
+func getLimitRules(product, packageType, model string, overrides userOverrides) *ResolvedRule {
+	set := currentLimits()
+	resolved := &ResolvedRule{
+		Product:   product,
+		Package:   packageType,
+		Model:     model,
+		Canonical: canonicalModel(model),
 	}
 
-	if storedPackage != packageType {
-		// 如果套餐发生变化，重置计数器并更新套餐信息
-		if err := RedisClient.Set(redisKey, 0, time.Duration(windowSeconds)*time.Second); err != nil {
-			return false, "", fmt.Errorf("重置计数器失败: %w", err)
-		}
-		if err := RedisClient.Set(userPackageKey, packageType, 0); err != nil {
-			return false, "", fmt.Errorf("更新套餐信息失败: %w", err)
+	if packageRules := set.packageRules(product, packageType); packageRules != nil {
+		if matchedBy, ruleKey, rule := packageRules.match(resolved.Canonical); rule != nil {
+			resolved.MatchedBy, resolved.RuleKey, resolved.Rules = matchedBy, ruleKey, rule
 		}
 	}
+	if resolved.Rules == nil && set.other != nil {
+		resolved.MatchedBy, resolved.RuleKey, resolved.Rules = MatchOther, "other", set.other
+	}
 
-	// 获取当前计数器值
-	currentCount, err := RedisClient.GetInt(redisKey)
-	if err != nil && err.Error() != "redis: nil" {
-		return false, "", fmt.Errorf("获取当前计数失败: %w", err)
+	names := []string{resolved.Canonical}
+	if resolved.RuleKey != "" && resolved.RuleKey != resolved.Canonical {
+		names = append(names, resolved.RuleKey)
 	}
+	if rules, override := overrides.apply(resolved.Rules, names...); override != nil {
+		resolved.Rules, resolved.Override = rules, override
+		if override.Key == resolved.Canonical && override.rules != nil {
+			// 为模型单独设置的绝对规则使用模型自己的计数器
+			resolved.MatchedBy, resolved.RuleKey = MatchOverride, resolved.Canonical
+		}
+	}
+	if resolved.Rules == nil {
+		return nil
+	}
+	resolved.RuleText = resolved.Rules.String()
+	return resolved
+}
 
-	// 检查是否超过速率限制
-	if currentCount >= maxCount {
-		return false, fmt.Sprintf("超过速率限制：在该%s套餐下，%s模型每%d分钟允许%d条消息，请稍后重试或升级套餐。",
-			packageType, model, windowSeconds/60, maxCount), nil
+// packageKey 返回用户激活套餐中产品对应的键，未配置的产品使用产品名
+func packageKey(product string) string {
+	if rules, exists := currentLimits().products[product]; exists {
+		return rules.packageKey
 	}
+	return product
+}
+
+// GetStarLimit 检查用户在指定模型下的速率限制，并返回是否允许发送消息
+// 参数: pkg - 用户在请求产品下生效的套餐，见PackageResolver, model - 模型名称, tokens - 提问的估算token数，用于按token计量的规则
+// 返回: (是否允许发送消息, 消息内容, 额度预留ID, 错误)
+// 允许发送时扣除的额度记录为一个预留，请求完成后通过 ConfirmReservation 确认或 RefundReservation 退还；
+// 没有扣除额度时预留ID为空
+func GetStarLimit(pkg *UserPackage, model string, tokens int) (bool, string, string, error) {
+	xuserid, product, packageType := pkg.UserID, pkg.Product, pkg.Level
 
-	// 如果没有超过限制，递增计数器
-	newCount, err := RedisClient.Incr(redisKey)
+	// 获取速率限制规则（加载时已解析），同时包括共享额度组和积分额度的计数器
+	now := time.Now()
+	overrides, err := loadOverrides(xuserid, now)
 	if err != nil {
-		return false, "", fmt.Errorf("递增计数器失败: %w", err)
+		return false, "", "", err
+	}
+	resolved, counters := buildCounters(product, packageType, model, xuserid, tokens, overrides, now)
+	if credits, _ := creditsRule(product, packageType, overrides); resolved == nil && credits == nil && len(counters) == 0 {
+		return false, "未配置速率限制", "", nil
+	}
+	if len(counters) == 0 {
+		// 积分额度下权重为0的模型不消耗额度
+		return true, "允许发送消息", "", nil
 	}
 
-	if newCount == 1 {
-		// 如果是第一次递增，设置过期时间
-		if err := RedisClient.Expire(redisKey, time.Duration(windowSeconds)*time.Second); err != nil {
-			return false, "", fmt.Errorf("设置过期时间失败: %w", err)
+	userPackageKey := keys.RateLimitPackage(xuserid, productScope(product))
+
+	// 检查用户当前套餐是否发生变化，GETSET保证并发请求中只有一个执行迁移
+	storedPackage, err := RedisClient.GetSet(userPackageKey, packageType)
+	if err != nil && err != redis.Nil {
+		return false, "", "", fmt.Errorf("获取存储的套餐信息失败: %w", err)
+	}
+	if err == nil && storedPackage != packageType {
+		// 套餐发生变化，按配置的策略迁移旧套餐的所有计数器
+		if err := transitionPackage(xuserid, product, storedPackage, packageType, overrides, now); err != nil {
+			return false, "", "", err
 		}
 	}
 
-	return true, "允许发送消息", nil
-} 
\ No newline at end of file
+	// 原子地检查并递增所有计数器
+	denied, err := consumeCounters(xuserid, product, packageType, counters, now)
+	if err != nil {
+		return false, "", "", err
+	}
+	if denied == nil {
+		// 额度已经扣除，预留保存失败时仍然允许发送，只是不能退还
+		reservationID, err := createReservation(xuserid, product, packageType, model, counters, now)
+		if err != nil {
+			fmt.Printf("用户 %s 的额度预留保存失败: %v\n", xuserid, err)
+		}
+		return true, "允许发送消息", reservationID, nil
+	}
+
+	// 超过速率限制，提示具体的限制和重置时间
+	rule := denied.rule
+	msg := denied.deniedMessage(packageType, model, tokens)
+	ttl, err := RedisClient.TTL(denied.key)
+	if err != nil {
+		return false, "", "", fmt.Errorf("获取计数器过期时间失败: %w", err)
+	}
+	if resetAt, ok := rule.ResetTime(now, ttl); ok {
+		msg += fmt.Sprintf("额度将于%s重置。", rule.ResetTimeText(resetAt))
+	}
+	return false, msg, "", nil
+}
@@ -0,0 +1,163 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// OverrideAll 覆盖用户所有规则的配置项名称，只能使用倍率
+const OverrideAll = "*"
+
+// LimitOverride 单个用户的限速覆盖，在套餐规则之前生效
+// Rule 为绝对规则，直接替换套餐中的规则；Multiplier 为倍率，按比例放大或缩小套餐中规则的次数，两者只能设置一个
+type LimitOverride struct {
+	Key        string     `json:"key"`                  // 覆盖的配置项：模型名、通配模式、group:组名、credits 或 *
+	Rule       string     `json:"rule,omitempty"`       // 绝对规则，格式与limit.json相同，如 "100/3h, 200000tok/1d"
+	Multiplier float64    `json:"multiplier,omitempty"` // 倍率，如 2 表示额度翻倍，0.5 表示减半
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // 过期时间，为空表示永久有效
+	Reason     string     `json:"reason,omitempty"`     // 备注，如工单号
+	CreatedAt  time.Time  `json:"created_at"`
+
+	rules RuleList // 解析后的绝对规则
+}
+
+// Validate 校验覆盖配置，并解析绝对规则
+func (o *LimitOverride) Validate() error {
+	if o.Key == "" {
+		return fmt.Errorf("覆盖的配置项不能为空")
+	}
+	if (o.Rule == "") == (o.Multiplier == 0) {
+		return fmt.Errorf("rule 和 multiplier 必须且只能设置一个")
+	}
+	if o.Multiplier < 0 || math.IsNaN(o.Multiplier) || math.IsInf(o.Multiplier, 0) {
+		return fmt.Errorf("倍率必须是正数，当前为 %v", o.Multiplier)
+	}
+	if o.Rule != "" {
+		if o.Key == OverrideAll {
+			return fmt.Errorf("%s 只能设置倍率", OverrideAll)
+		}
+		rules, err := ParseRuleList(o.Rule)
+		if err != nil {
+			return err
+		}
+		if o.Key == CreditsRuleKey && (len(rules) != 1 || rules[0].Unit != UnitMessage) {
+			return fmt.Errorf("积分额度只能配置一条 '积分/时长' 规则")
+		}
+		o.rules = rules
+	}
+	return nil
+}
+
+// expired 判断覆盖是否已过期
+func (o *LimitOverride) expired(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
+
+// userOverrides 用户当前生效的覆盖，键为覆盖的配置项
+type userOverrides map[string]*LimitOverride
+
+// apply 对规则应用覆盖，按 names 的顺序查找覆盖，最后查找 OverrideAll；没有可用的覆盖时原样返回
+// 倍率覆盖只对已有的规则生效，绝对规则在套餐未配置该项时也会生效
+func (o userOverrides) apply(rules RuleList, names ...string) (RuleList, *LimitOverride) {
+	for _, name := range append(names[:len(names):len(names)], OverrideAll) {
+		override, exists := o[name]
+		if !exists {
+			continue
+		}
+		if override.rules != nil {
+			return override.rules, override
+		}
+		if rules != nil {
+			return rules.Scale(override.Multiplier), override
+		}
+	}
+	return rules, nil
+}
+
+// loadOverrides 读取用户的所有覆盖，已过期的覆盖会被顺带删除
+func loadOverrides(xuserid string, now time.Time) (userOverrides, error) {
+	redisKey := keys.LimitOverrides(xuserid)
+	fields, err := RedisClient.HGetAll(redisKey)
+	if err != nil {
+		return nil, fmt.Errorf("获取用户限速覆盖失败: %w", err)
+	}
+
+	overrides := make(userOverrides, len(fields))
+	var expired []string
+	for key, value := range fields {
+		override := &LimitOverride{}
+		if err := json.Unmarshal([]byte(value), override); err != nil {
+			fmt.Printf("用户 %s 的限速覆盖 %s 格式错误，已忽略: %v\n", xuserid, key, err)
+			continue
+		}
+		override.Key = key
+		if override.expired(now) {
+			expired = append(expired, key)
+			continue
+		}
+		if err := override.Validate(); err != nil {
+			fmt.Printf("用户 %s 的限速覆盖 %s 无效，已忽略: %v\n", xuserid, key, err)
+			continue
+		}
+		overrides[key] = override
+	}
+
+	if len(expired) > 0 {
+		if err := RedisClient.HDel(redisKey, expired...); err != nil {
+			fmt.Printf("删除用户 %s 已过期的限速覆盖失败: %v\n", xuserid, err)
+		}
+	}
+	return overrides, nil
+}
+
+// GetLimitOverrides 返回用户当前生效的覆盖，按配置项排序
+func GetLimitOverrides(xuserid string) ([]*LimitOverride, error) {
+	overrides, err := loadOverrides(xuserid, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*LimitOverride, 0, len(overrides))
+	for _, key := range sortedKeys(overrides) {
+		list = append(list, overrides[key])
+	}
+	return list, nil
+}
+
+// SetLimitOverride 设置用户的覆盖，同一配置项已有覆盖时替换
+func SetLimitOverride(xuserid string, override *LimitOverride) error {
+	if err := override.Validate(); err != nil {
+		return err
+	}
+	if override.expired(time.Now()) {
+		return fmt.Errorf("过期时间必须晚于当前时间")
+	}
+	if override.CreatedAt.IsZero() {
+		override.CreatedAt = time.Now()
+	}
+
+	value, err := json.Marshal(override)
+	if err != nil {
+		return fmt.Errorf("序列化限速覆盖失败: %w", err)
+	}
+	if err := RedisClient.HSet(keys.LimitOverrides(xuserid), override.Key, string(value)); err != nil {
+		return fmt.Errorf("保存限速覆盖失败: %w", err)
+	}
+	return nil
+}
+
+// DeleteLimitOverrides 删除用户指定配置项的覆盖，keys为空时删除全部覆盖
+func DeleteLimitOverrides(xuserid string, overrideKeys ...string) error {
+	redisKey := keys.LimitOverrides(xuserid)
+	var err error
+	if len(overrideKeys) == 0 {
+		err = RedisClient.Delete(redisKey)
+	} else {
+		err = RedisClient.HDel(redisKey, overrideKeys...)
+	}
+	if err != nil {
+		return fmt.Errorf("删除限速覆盖失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"limit_service/config"
+)
+
+// ErrUnknownLevel 用户激活的套餐等级在限速配置中不存在
+var ErrUnknownLevel = errors.New("未知的套餐等级")
+
+// errInvalidPackage 用户的激活套餐数据格式错误
+var errInvalidPackage = errors.New("用户套餐数据格式错误")
+
+// maxPackageCacheEntries 缓存的用户数上限，超过时清理已过期的缓存
+const maxPackageCacheEntries = 10000
+
+// UserPackage 用户在某个产品下生效的套餐
+type UserPackage struct {
+	UserID      string     `json:"user_id"`
+	Product     string     `json:"product"`
+	Level       string     `json:"level"`                  // 生效的套餐等级，未激活或已过期时为默认等级
+	ActiveLevel string     `json:"active_level,omitempty"` // 用户激活套餐中记录的等级
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`   // 套餐过期时间，为空表示不过期
+	Expired     bool       `json:"expired"`
+	Fallback    string     `json:"fallback,omitempty"` // 激活套餐无法使用而按默认等级处理的原因
+}
+
+// packageCacheEntry 一个用户的激活套餐缓存
+type packageCacheEntry struct {
+	data      map[string]interface{} // active_packages的内容，用户没有激活套餐时为nil
+	fetchedAt time.Time
+}
+
+// PackageResolver 读取并解析用户的激活套餐，结果在进程内缓存一小段时间
+// 套餐的过期时间在每次解析时判断，缓存不会让已过期的套餐继续生效
+type PackageResolver struct {
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]packageCacheEntry
+}
+
+// 全局套餐解析器，InitPackageResolver时根据配置替换
+var Packages = NewPackageResolver(0)
+
+// NewPackageResolver 创建套餐解析器，ttl为0时不缓存
+func NewPackageResolver(ttl time.Duration) *PackageResolver {
+	return &PackageResolver{
+		ttl:   ttl,
+		cache: make(map[string]packageCacheEntry),
+	}
+}
+
+// InitPackageResolver 根据配置初始化全局套餐解析器
+func InitPackageResolver() {
+	Packages = NewPackageResolver(config.GetConfig().Policies.PackageCacheTTL)
+	fmt.Printf("套餐解析器初始化完成，缓存时间 %s\n", Packages.ttl)
+}
+
+// Resolve 返回用户在指定产品下生效的套餐
+// 未激活或已过期的套餐按默认等级处理；套餐数据格式错误或激活的等级在限速配置中不存在时，
+// 记录日志并按默认等级处理，原因写入 Fallback；开启 policies.deny_unknown_level 时未知的等级返回 ErrUnknownLevel
+func (r *PackageResolver) Resolve(xuserid, product string) (*UserPackage, error) {
+	defaultLevel := config.GetConfig().Policies.DefaultLevel
+	pkg := &UserPackage{UserID: xuserid, Product: product, Level: defaultLevel}
+
+	data, err := r.activePackages(xuserid)
+	if errors.Is(err, errInvalidPackage) {
+		return pkg.fallback(err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := packageKey(product)
+	raw, exists := data[key]
+	if !exists || raw == nil {
+		return pkg, nil
+	}
+	if err := pkg.parse(key, raw); err != nil {
+		return pkg.fallback(err), nil
+	}
+	if pkg.Expired {
+		return pkg, nil
+	}
+
+	if pkg.ActiveLevel != defaultLevel && !currentLimits().hasPackage(product, pkg.ActiveLevel) {
+		err := fmt.Errorf("%w: 用户 %s 在产品 %s 下的等级为 %s", ErrUnknownLevel, xuserid, product, pkg.ActiveLevel)
+		if config.GetConfig().Policies.DenyUnknownLevel {
+			return nil, err
+		}
+		return pkg.fallback(err), nil
+	}
+	pkg.Level = pkg.ActiveLevel
+	return pkg, nil
+}
+
+// parse 读取产品套餐数据中的等级和过期时间
+func (p *UserPackage) parse(key string, raw interface{}) error {
+	productData, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: %s 不是对象", errInvalidPackage, key)
+	}
+	level, ok := productData["level"].(string)
+	if !ok || level == "" {
+		return fmt.Errorf("%w: %s.level 不是字符串", errInvalidPackage, key)
+	}
+	p.ActiveLevel = strings.ToLower(level)
+
+	if value, exists := productData["expires_at"]; exists && value != nil {
+		expiresAt, err := parseExpiresAt(value)
+		if err != nil {
+			return fmt.Errorf("%w: %s.expires_at: %v", errInvalidPackage, key, err)
+		}
+		p.ExpiresAt = &expiresAt
+		p.Expired = !time.Now().Before(expiresAt)
+	}
+	return nil
+}
+
+// fallback 记录激活套餐无法使用的原因，按默认等级处理
+func (p *UserPackage) fallback(reason error) *UserPackage {
+	p.Level = config.GetConfig().Policies.DefaultLevel
+	p.Fallback = reason.Error()
+	fmt.Printf("用户 %s 在产品 %s 下按默认等级 %s 处理: %v\n", p.UserID, p.Product, p.Level, reason)
+	return p
+}
+
+// Invalidate 删除用户的缓存，下次解析时重新读取Redis
+func (r *PackageResolver) Invalidate(xuserid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cache, xuserid)
+}
+
+// activePackages 读取用户的激活套餐，优先使用未过期的缓存
+func (r *PackageResolver) activePackages(xuserid string) (map[string]interface{}, error) {
+	now := time.Now()
+	if r.ttl > 0 {
+		r.mu.Lock()
+		entry, exists := r.cache[xuserid]
+		r.mu.Unlock()
+		if exists && now.Sub(entry.fetchedAt) < r.ttl {
+			return entry.data, nil
+		}
+	}
+
+	value, err := RedisClient.Get(keys.ActivePackages(xuserid))
+	if err != nil {
+		return nil, fmt.Errorf("获取用户套餐信息失败: %w", err)
+	}
+	var data map[string]interface{}
+	if value != nil {
+		var ok bool
+		if data, ok = value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%w: 不是对象", errInvalidPackage)
+		}
+	}
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= maxPackageCacheEntries {
+			r.evictExpired(now)
+		}
+		r.cache[xuserid] = packageCacheEntry{data: data, fetchedAt: now}
+		r.mu.Unlock()
+	}
+	return data, nil
+}
+
+// evictExpired 清理过期的缓存，仍然超过上限时清空缓存，调用方需持有锁
+func (r *PackageResolver) evictExpired(now time.Time) {
+	for xuserid, entry := range r.cache {
+		if now.Sub(entry.fetchedAt) >= r.ttl {
+			delete(r.cache, xuserid)
+		}
+	}
+	if len(r.cache) >= maxPackageCacheEntries {
+		r.cache = make(map[string]packageCacheEntry)
+	}
+}
+
+// parseExpiresAt 解析套餐的过期时间，支持Unix时间戳（秒或毫秒）、RFC3339和 "2006-01-02 15:04:05"（默认时区）
+func parseExpiresAt(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case float64:
+		return unixTime(int64(v)), nil
+	case string:
+		if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return unixTime(ts), nil
+		}
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+		if t, err := time.ParseInLocation(time.DateTime, v, defaultLocation()); err == nil {
+			return t, nil
+		}
+		return time.Time{}, fmt.Errorf("无法解析的时间: %q", v)
+	default:
+		return time.Time{}, fmt.Errorf("无法解析的时间: %v", value)
+	}
+}
+
+// unixTime 将Unix时间戳转换为时间，大于1e12的按毫秒处理
+func unixTime(ts int64) time.Time {
+	if ts > 1e12 {
+		return time.UnixMilli(ts)
+	}
+	return time.Unix(ts, 0)
+}
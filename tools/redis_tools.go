@@ -2,9 +2,12 @@ package tools
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -13,7 +16,7 @@ import (
 
 // RedisTool Redis工具结构体
 type RedisTool struct {
-	client *redis.Client
+	client redis.UniversalClient
 	prefix string
 	ctx    context.Context
 }
@@ -21,33 +24,90 @@ type RedisTool struct {
 // 全局Redis工具实例
 var RedisClient *RedisTool
 
+// NewRedisTool 使用已有的客户端创建Redis工具
+func NewRedisTool(client redis.UniversalClient, prefix string) *RedisTool {
+	return &RedisTool{
+		client: client,
+		prefix: prefix,
+		ctx:    context.Background(),
+	}
+}
+
 // InitRedis 初始化Redis连接
 func InitRedis() error {
 	cfg := config.GetConfig()
-	
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%d", cfg.Redis.Host, cfg.Redis.Port),
-		Password: cfg.Redis.Password,
-		DB:       cfg.Redis.DB,
-	})
+
+	schema, err := NewKeySchema(cfg.Keys, cfg.Redis.Mode == config.RedisModeCluster)
+	if err != nil {
+		return err
+	}
+
+	rdb, err := newRedisClient(cfg.Redis)
+	if err != nil {
+		return err
+	}
 
 	// 测试连接
 	ctx := context.Background()
-	_, err := rdb.Ping(ctx).Result()
+	_, err = rdb.Ping(ctx).Result()
 	if err != nil {
 		return fmt.Errorf("Redis连接失败: %w", err)
 	}
 
-	RedisClient = &RedisTool{
-		client: rdb,
-		prefix: "star:",
-		ctx:    ctx,
-	}
+	RedisClient = NewRedisTool(rdb, cfg.Keys.Prefix)
+	keys = schema
 
-	fmt.Println("Redis连接成功")
+	fmt.Printf("Redis连接成功 (模式: %s)\n", cfg.Redis.Mode)
 	return nil
 }
 
+// newRedisClient 根据部署模式创建单机、哨兵或集群客户端
+func newRedisClient(cfg config.RedisConfig) (redis.UniversalClient, error) {
+	addrs := cfg.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)}
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		DB:               cfg.DB,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		MasterName:       cfg.MasterName,
+		SentinelPassword: cfg.SentinelPassword,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		DialTimeout:      cfg.DialTimeout,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+		PoolTimeout:      cfg.PoolTimeout,
+	}
+	if cfg.TLS {
+		opts.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.TLSSkipVerify,
+		}
+	}
+
+	// 模式相关的参数已在config.Validate中校验
+	switch cfg.Mode {
+	case config.RedisModeSingle:
+		return redis.NewClient(opts.Simple()), nil
+	case config.RedisModeSentinel:
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case config.RedisModeCluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("未知的Redis模式: %s", cfg.Mode)
+	}
+}
+
+// HashTag 将标识包装为Redis Cluster哈希标签，
+// 同一用户的限速相关键落在同一槽位，多键脚本在集群模式下也能执行
+func HashTag(id string) string {
+	return "{" + id + "}"
+}
+
 // getKey 返回带有前缀的键名
 func (r *RedisTool) getKey(key string) string {
 	return r.prefix + key
@@ -56,7 +116,7 @@ func (r *RedisTool) getKey(key string) string {
 // Set 设置键值对到Redis中
 func (r *RedisTool) Set(key string, value interface{}, expiration time.Duration) error {
 	fullKey := r.getKey(key)
-	
+
 	// 如果value是复杂类型，序列化为JSON
 	var val string
 	switch v := value.(type) {
@@ -130,6 +190,12 @@ func (r *RedisTool) Expire(key string, expiration time.Duration) error {
 	return r.client.Expire(r.ctx, fullKey, expiration).Err()
 }
 
+// ExpireAt 设置过期的时间点
+func (r *RedisTool) ExpireAt(key string, tm time.Time) error {
+	fullKey := r.getKey(key)
+	return r.client.ExpireAt(r.ctx, fullKey, tm).Err()
+}
+
 // Incr 自增
 func (r *RedisTool) Incr(key string) (int64, error) {
 	fullKey := r.getKey(key)
@@ -140,4 +206,127 @@ func (r *RedisTool) Incr(key string) (int64, error) {
 func (r *RedisTool) TTL(key string) (time.Duration, error) {
 	fullKey := r.getKey(key)
 	return r.client.TTL(r.ctx, fullKey).Result()
-} 
\ No newline at end of file
+}
+
+// RunScript 执行Lua脚本，keys会自动加上前缀
+func (r *RedisTool) RunScript(script *redis.Script, keys []string, args ...interface{}) (interface{}, error) {
+	fullKeys := make([]string, len(keys))
+	for i, key := range keys {
+		fullKeys[i] = r.getKey(key)
+	}
+	return script.Run(r.ctx, r.client, fullKeys, args...).Result()
+}
+
+// HGetAll 获取哈希表的所有字段
+func (r *RedisTool) HGetAll(key string) (map[string]string, error) {
+	fullKey := r.getKey(key)
+	return r.client.HGetAll(r.ctx, fullKey).Result()
+}
+
+// HSet 设置哈希表字段
+func (r *RedisTool) HSet(key, field, value string) error {
+	fullKey := r.getKey(key)
+	return r.client.HSet(r.ctx, fullKey, field, value).Err()
+}
+
+// HDel 删除哈希表字段
+func (r *RedisTool) HDel(key string, fields ...string) error {
+	fullKey := r.getKey(key)
+	return r.client.HDel(r.ctx, fullKey, fields...).Err()
+}
+
+// GetSet 设置新值并返回旧值，键不存在时返回redis.Nil
+func (r *RedisTool) GetSet(key string, value string) (string, error) {
+	fullKey := r.getKey(key)
+	return r.client.GetSet(r.ctx, fullKey, value).Result()
+}
+
+// LPush 从列表头部插入元素
+func (r *RedisTool) LPush(key string, values ...interface{}) error {
+	fullKey := r.getKey(key)
+	return r.client.LPush(r.ctx, fullKey, values...).Err()
+}
+
+// LTrim 只保留列表指定范围内的元素
+func (r *RedisTool) LTrim(key string, start, stop int64) error {
+	fullKey := r.getKey(key)
+	return r.client.LTrim(r.ctx, fullKey, start, stop).Err()
+}
+
+// LRange 获取列表指定范围内的元素
+func (r *RedisTool) LRange(key string, start, stop int64) ([]string, error) {
+	fullKey := r.getKey(key)
+	return r.client.LRange(r.ctx, fullKey, start, stop).Result()
+}
+
+// SetKeepTTL 设置值并保留键原有的过期时间
+func (r *RedisTool) SetKeepTTL(key string, value interface{}) error {
+	fullKey := r.getKey(key)
+	return r.client.Set(r.ctx, fullKey, value, redis.KeepTTL).Err()
+}
+
+// ZRem 从有序集合中删除成员，返回删除的个数
+func (r *RedisTool) ZRem(key string, members ...interface{}) (int64, error) {
+	fullKey := r.getKey(key)
+	return r.client.ZRem(r.ctx, fullKey, members...).Result()
+}
+
+// ZAdd 向有序集合添加成员
+func (r *RedisTool) ZAdd(key string, score float64, member string) error {
+	fullKey := r.getKey(key)
+	return r.client.ZAdd(r.ctx, fullKey, &redis.Z{Score: score, Member: member}).Err()
+}
+
+// ZRangeByScore 返回有序集合中分数在[min, max]之间的前count个成员
+func (r *RedisTool) ZRangeByScore(key string, min, max int64, count int64) ([]string, error) {
+	fullKey := r.getKey(key)
+	return r.client.ZRangeByScore(r.ctx, fullKey, &redis.ZRangeBy{
+		Min:   strconv.FormatInt(min, 10),
+		Max:   strconv.FormatInt(max, 10),
+		Count: count,
+	}).Result()
+}
+
+// ZRevRangeWithScores 按分数从高到低返回有序集合的所有成员和分数
+func (r *RedisTool) ZRevRangeWithScores(key string) ([]redis.Z, error) {
+	fullKey := r.getKey(key)
+	return r.client.ZRevRangeWithScores(r.ctx, fullKey, 0, -1).Result()
+}
+
+// ZCount 返回有序集合中分数在[min, max]之间的成员个数
+func (r *RedisTool) ZCount(key string, min, max int64) (int64, error) {
+	fullKey := r.getKey(key)
+	return r.client.ZCount(r.ctx, fullKey, strconv.FormatInt(min, 10), strconv.FormatInt(max, 10)).Result()
+}
+
+// ScanKeys 返回匹配模式的所有键（不含前缀），集群模式下遍历每个主节点
+// 使用SCAN分批遍历，不会像KEYS那样阻塞Redis
+func (r *RedisTool) ScanKeys(pattern string) ([]string, error) {
+	match := r.getKey(pattern)
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, match, 500).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			keys = append(keys, strings.TrimPrefix(iter.Val(), r.prefix))
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := r.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(r.ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(r.ctx, r.client)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
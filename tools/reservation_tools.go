@@ -0,0 +1,218 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// reservationSweepInterval 检查超时未确认的额度预留的间隔
+const reservationSweepInterval = 30 * time.Second
+
+// reservationSweepBatch 每次检查最多处理的额度预留数
+const reservationSweepBatch = 100
+
+// reservationWindowTolerance 判断计数器是否仍在扣除额度时的窗口所允许的过期时间误差，吸收各实例之间的时钟偏差
+// 旧窗口结束后重新创建的计数器的过期时间至少晚一个窗口长度（不小于1秒），不会落在误差范围内
+const reservationWindowTolerance = 500 * time.Millisecond
+
+// refundScript 删除额度预留并退还扣除的额度，预留已经不存在时不做任何操作，保证只退还一次
+// KEYS[1] 额度预留，KEYS[2..] 计数器键，与预留位于同一哈希槽
+// ARGV[1]: 当前时间(毫秒时间戳)，ARGV[2]: 过期时间的误差毫秒数；之后每个计数器依次为 增量、扣除时的过期时间点(毫秒时间戳，0表示不检查)
+// 返回: 1 已退还，0 预留不存在
+var refundScript = redis.NewScript(`
+if redis.call('DEL', KEYS[1]) == 0 then
+	return 0
+end
+local now = tonumber(ARGV[1])
+local tolerance = tonumber(ARGV[2])
+for i = 2, #KEYS do
+	local base = (i - 2) * 2 + 3
+	local current = tonumber(redis.call('GET', KEYS[i]) or '0')
+	local expireAt = tonumber(ARGV[base + 1])
+	local pttl = redis.call('PTTL', KEYS[i])
+	-- 计数器已过期、被重置或已经是新窗口的计数器时不再退还
+	local sameWindow = expireAt == 0 or (pttl > 0 and math.abs(now + pttl - expireAt) < tolerance)
+	if current > 0 and sameWindow then
+		redis.call('DECRBY', KEYS[i], math.min(current, tonumber(ARGV[base])))
+	end
+end
+return 1
+`)
+
+// confirmScript 删除额度预留，确认和退还（包括超时退还）都以删除预留决定由谁完成，保证只有一个生效
+// 未确认的预留的有序集合与预留位于不同的哈希槽，不能放在同一个脚本中，只作为超时处理的索引
+// KEYS[1] 额度预留
+// 返回: 1 已确认，0 预留不存在（已确认、已退还或已超时处理）
+var confirmScript = redis.NewScript(`
+return redis.call('DEL', KEYS[1])
+`)
+
+// reservation 一次请求扣除的额度，请求完成后确认或退还
+type reservation struct {
+	UserID    string               `json:"user_id"`
+	Product   string               `json:"product"`
+	Package   string               `json:"package"`
+	Model     string               `json:"model"`
+	Counters  []reservationCounter `json:"counters"`
+	CreatedAt time.Time            `json:"created_at"`
+}
+
+// reservationCounter 额度预留中的一个计数器
+// 对齐窗口的键中带有窗口标识；非对齐窗口的计数器过期后会以相同的键重新创建，按扣除时的过期时间区分窗口
+type reservationCounter struct {
+	Key       string `json:"key"`
+	Increment int64  `json:"increment"`
+	ExpireAt  int64  `json:"expire_at,omitempty"` // 扣除额度后计数器的过期时间点(毫秒时间戳)
+}
+
+// createReservation 记录本次请求扣除的额度，返回预留ID
+// 预留需要在 policies.reservation_timeout 内通过 ConfirmReservation 或 RefundReservation 完成
+func createReservation(xuserid, product, packageType, model string, counters []*limitCounter, now time.Time) (string, error) {
+	id, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	data := reservation{
+		UserID:    xuserid,
+		Product:   product,
+		Package:   packageType,
+		Model:     model,
+		Counters:  make([]reservationCounter, 0, len(counters)),
+		CreatedAt: now,
+	}
+	for _, counter := range counters {
+		data.Counters = append(data.Counters, reservationCounter{Key: counter.key, Increment: counter.increment, ExpireAt: counter.expireAt})
+	}
+
+	// 预留的保存时间是超时时间的两倍，清理任务没有运行时也会自动过期（相当于保留额度）
+	timeout := config.GetConfig().Policies.ReservationTimeout
+	key := keys.Reservation(xuserid, id)
+	if err := RedisClient.Set(key, data, 2*timeout); err != nil {
+		return "", fmt.Errorf("保存额度预留失败: %w", err)
+	}
+	if err := RedisClient.ZAdd(keys.Reservations(), float64(now.Add(timeout).UnixMilli()), key); err != nil {
+		return "", fmt.Errorf("保存额度预留失败: %w", err)
+	}
+	return id, nil
+}
+
+// ConfirmReservation 确认请求成功，保留扣除的额度，返回预留是否存在（已完成或已超时时为false）
+func ConfirmReservation(xuserid, id string) (bool, error) {
+	key := keys.Reservation(xuserid, id)
+	result, err := RedisClient.RunScript(confirmScript, []string{key})
+	if err != nil {
+		return false, fmt.Errorf("确认额度预留失败: %w", err)
+	}
+	deleted, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("确认额度预留脚本返回值格式错误: %v", result)
+	}
+	if _, err := RedisClient.ZRem(keys.Reservations(), key); err != nil {
+		return false, fmt.Errorf("确认额度预留失败: %w", err)
+	}
+	return deleted == 1, nil
+}
+
+// RefundReservation 请求失败时退还扣除的额度，返回是否退还（已完成或已超时时为false）
+func RefundReservation(xuserid, id string) (bool, error) {
+	key := keys.Reservation(xuserid, id)
+	refunded, err := refundReservation(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := RedisClient.ZRem(keys.Reservations(), key); err != nil {
+		return false, fmt.Errorf("退还额度预留失败: %w", err)
+	}
+	return refunded, nil
+}
+
+// refundReservation 按预留中记录的计数器退还额度
+func refundReservation(key string) (bool, error) {
+	value, err := RedisClient.GetString(key)
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("获取额度预留失败: %w", err)
+	}
+	var data reservation
+	if err := json.Unmarshal([]byte(value), &data); err != nil {
+		// 格式错误的预留无法退还，直接删除
+		fmt.Printf("额度预留 %s 格式错误，已删除: %v\n", key, err)
+		return false, RedisClient.Delete(key)
+	}
+
+	redisKeys := make([]string, 0, len(data.Counters)+1)
+	args := make([]interface{}, 0, len(data.Counters)*2+2)
+	redisKeys = append(redisKeys, key)
+	args = append(args, time.Now().UnixMilli(), reservationWindowTolerance.Milliseconds())
+	for _, counter := range data.Counters {
+		redisKeys = append(redisKeys, counter.Key)
+		args = append(args, counter.Increment, counter.ExpireAt)
+	}
+	result, err := RedisClient.RunScript(refundScript, redisKeys, args...)
+	if err != nil {
+		return false, fmt.Errorf("退还额度失败: %w", err)
+	}
+	refunded, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("退还额度脚本返回值格式错误: %v", result)
+	}
+	return refunded == 1, nil
+}
+
+// StartReservationSweeper 定期处理超时未确认的额度预留，按 policies.reservation_policy 保留或退还额度
+func StartReservationSweeper() {
+	policies := config.GetConfig().Policies
+	fmt.Printf("额度预留清理已启动，超时时间 %s，超时策略 %s\n", policies.ReservationTimeout, policies.ReservationPolicy)
+	go func() {
+		ticker := time.NewTicker(reservationSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sweepReservations(time.Now()); err != nil {
+				fmt.Printf("处理超时的额度预留失败: %v\n", err)
+			}
+		}
+	}()
+}
+
+// sweepReservations 处理截止时间早于now的额度预留
+// 多个实例同时清理时，只有从有序集合中删除成功的实例处理该预留
+func sweepReservations(now time.Time) error {
+	refund := config.GetConfig().Policies.ReservationPolicy == config.ReservationRefund
+	for {
+		expired, err := RedisClient.ZRangeByScore(keys.Reservations(), 0, now.UnixMilli(), reservationSweepBatch)
+		if err != nil {
+			return fmt.Errorf("获取超时的额度预留失败: %w", err)
+		}
+		for _, key := range expired {
+			removed, err := RedisClient.ZRem(keys.Reservations(), key)
+			if err != nil {
+				return fmt.Errorf("删除超时的额度预留失败: %w", err)
+			}
+			if removed == 0 {
+				continue
+			}
+			if !refund {
+				if err := RedisClient.Delete(key); err != nil {
+					return fmt.Errorf("删除超时的额度预留失败: %w", err)
+				}
+				continue
+			}
+			refunded, err := refundReservation(key)
+			if err != nil {
+				return err
+			}
+			if refunded {
+				fmt.Printf("额度预留 %s 超时未确认，已退还额度\n", key)
+			}
+		}
+		if len(expired) < reservationSweepBatch {
+			return nil
+		}
+	}
+}
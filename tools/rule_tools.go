@@ -0,0 +1,349 @@
+package tools
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"limit_service/config"
+)
+
+// 时间单位，按解析时的匹配顺序排列（"mo"需要先于"m"匹配）
+var durationUnits = []struct {
+	suffix string
+	name   string
+	length time.Duration // 日历月长度不固定，为0
+}{
+	{"mo", "个月", 0},
+	{"w", "周", 7 * 24 * time.Hour},
+	{"d", "天", 24 * time.Hour},
+	{"h", "小时", time.Hour},
+	{"m", "分钟", time.Minute},
+	{"s", "秒", time.Second},
+}
+
+// 规则的计量单位
+const (
+	UnitMessage = "message" // 按消息条数计量
+	UnitToken   = "token"   // 按提问的估算token数计量
+	UnitCredit  = "credit"  // 按模型权重扣减积分
+)
+
+// tokenSuffix 按token计量的规则在次数后加的后缀，如 "200000tok/3h"
+const tokenSuffix = "tok"
+
+// LimitRule 预解析的限速规则
+// 格式为 '次数[tok]/时长[@时区]'，次数带 "tok" 后缀时按提问的估算token数计量，时长可以组合多个单位，如 "15/3h"、"20/1h30m"、"100/1mo"；
+// 带 '@' 时窗口按日历边界对齐，如 "5/1d@Asia/Shanghai" 表示每天上海时间0点重置，
+// "5/1h@" 表示每个整点重置，"5/1w@" 表示每周一0点重置，省略时区时使用配置的默认时区
+type LimitRule struct {
+	Raw    string        // 配置中的原始字符串，用于日志和提示
+	Count  int           // 窗口内允许的次数或token数
+	Unit   string        // 计量单位，UnitMessage或UnitToken
+	Window time.Duration // 窗口中固定长度的部分
+	Months int           // 窗口中日历月的部分
+
+	Aligned  bool           // 是否按日历边界对齐
+	Location *time.Location // 对齐使用的时区
+
+	unit      string // 对齐窗口的单位
+	unitCount int    // 对齐窗口包含的单位个数
+}
+
+// ParseLimitRule 解析限制配置，将 '次数/时长[@时区]' 解析为计数和时间窗口
+func ParseLimitRule(limitStr string) (*LimitRule, error) {
+	parts := strings.Split(limitStr, "/")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("限制格式错误: %q", limitStr)
+	}
+	// 时区名中也包含 '/'，只按第一个 '/' 拆分次数
+	countStr, duration := parts[0], strings.Join(parts[1:], "/")
+
+	unit := UnitMessage
+	if trimmed, ok := strings.CutSuffix(countStr, tokenSuffix); ok {
+		countStr, unit = trimmed, UnitToken
+	}
+
+	count, err := strconv.Atoi(countStr)
+	if err != nil {
+		return nil, fmt.Errorf("次数解析错误: %w", err)
+	}
+	if count < 0 {
+		return nil, fmt.Errorf("次数不能为负数: %q", limitStr)
+	}
+
+	rule := &LimitRule{Raw: limitStr, Count: count, Unit: unit}
+
+	if idx := strings.Index(duration, "@"); idx >= 0 {
+		zone := strings.TrimSpace(duration[idx+1:])
+		duration = duration[:idx]
+
+		rule.Aligned = true
+		rule.Location = defaultLocation()
+		if zone != "" {
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, fmt.Errorf("时区解析错误: %w", err)
+			}
+			rule.Location = loc
+		}
+	} else if strings.Contains(duration, "/") {
+		return nil, fmt.Errorf("限制格式错误: %q", limitStr)
+	}
+
+	if err := rule.parseDuration(duration); err != nil {
+		return nil, err
+	}
+	if rule.Window <= 0 && rule.Months <= 0 {
+		return nil, fmt.Errorf("时间窗口必须大于0: %q", limitStr)
+	}
+	if rule.Aligned {
+		if err := rule.checkAligned(); err != nil {
+			return nil, fmt.Errorf("%w: %q", err, limitStr)
+		}
+	}
+
+	return rule, nil
+}
+
+// RuleList 一个配置项中的多条规则，如 "15/3h, 200000tok/3h" 同时限制消息条数和token数
+type RuleList []*LimitRule
+
+// ParseRuleList 解析逗号分隔的多条规则，每种计量单位在同一配置项中最多出现一次
+func ParseRuleList(value string) (RuleList, error) {
+	var rules RuleList
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		rule, err := ParseLimitRule(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		if seen[rule.Unit] {
+			return nil, fmt.Errorf("同一配置项中 %s 规则重复: %q", rule.Unit, value)
+		}
+		seen[rule.Unit] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// String 返回规则的原始字符串
+func (l RuleList) String() string {
+	parts := make([]string, len(l))
+	for i, rule := range l {
+		parts[i] = rule.Raw
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Scale 返回次数按倍率缩放后的规则，时间窗口不变，用于用户的倍率覆盖
+func (l RuleList) Scale(multiplier float64) RuleList {
+	scaled := make(RuleList, len(l))
+	for i, rule := range l {
+		r := *rule
+		r.Count = int(math.Round(float64(rule.Count) * multiplier))
+		// 原始字符串中只替换次数部分，如 "15/3h" 按2倍缩放为 "30/3h"
+		r.Raw = strconv.Itoa(r.Count) + strings.TrimLeft(rule.Raw, "0123456789")
+		scaled[i] = &r
+	}
+	return scaled
+}
+
+// parseDuration 解析时长，支持纯数字秒数或 "1h30m" 这样的单位组合
+func (r *LimitRule) parseDuration(duration string) error {
+	if duration == "" {
+		return fmt.Errorf("时长不能为空")
+	}
+
+	// 兼容旧格式：纯数字表示秒数
+	if seconds, err := strconv.Atoi(duration); err == nil {
+		r.Window = time.Duration(seconds) * time.Second
+		r.unit, r.unitCount = "s", seconds
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	rest := duration
+	for rest != "" {
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 {
+			return fmt.Errorf("时长解析错误: %q 缺少数字", duration)
+		}
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil {
+			return fmt.Errorf("时长解析错误: %w", err)
+		}
+		rest = rest[digits:]
+
+		matched := false
+		for _, unit := range durationUnits {
+			if !strings.HasPrefix(rest, unit.suffix) {
+				continue
+			}
+			if seen[unit.suffix] {
+				return fmt.Errorf("时长解析错误: %q 中单位 %s 重复", duration, unit.suffix)
+			}
+			seen[unit.suffix] = true
+			if unit.length == 0 {
+				r.Months += n
+			} else {
+				r.Window += time.Duration(n) * unit.length
+			}
+			r.unit, r.unitCount = unit.suffix, n
+			rest = rest[len(unit.suffix):]
+			matched = true
+			break
+		}
+		if !matched {
+			return fmt.Errorf("时长解析错误: %q 包含未知单位", duration)
+		}
+	}
+
+	// 组合单位的窗口无法对齐到单一的日历边界
+	if len(seen) > 1 {
+		r.unit, r.unitCount = "", 0
+	}
+	return nil
+}
+
+// checkAligned 校验对齐窗口只使用单一单位，小于一天的窗口能整除一天，一天及以上的窗口是整天数
+// 用小时、分钟或秒表示的整天数窗口（如 48h）按天对齐
+func (r *LimitRule) checkAligned() error {
+	if r.unit == "" || r.unitCount <= 0 {
+		return fmt.Errorf("对齐窗口只能使用单一时间单位")
+	}
+	if r.Months > 0 || r.unit == "d" || r.unit == "w" {
+		return nil
+	}
+	const day = 24 * time.Hour
+	switch {
+	case r.Window < day:
+		if day%r.Window != 0 {
+			return fmt.Errorf("对齐窗口的长度必须能整除一天")
+		}
+	case r.Window%day != 0:
+		return fmt.Errorf("一天及以上的对齐窗口必须是整天数")
+	default:
+		r.unit, r.unitCount = "d", int(r.Window/day)
+	}
+	return nil
+}
+
+// Period 返回now所在窗口的起止时间
+// 对齐窗口按日历边界计算；非对齐窗口从now开始，即用户第一次请求的时间
+func (r *LimitRule) Period(now time.Time) (time.Time, time.Time) {
+	if !r.Aligned {
+		return now, now.AddDate(0, r.Months, 0).Add(r.Window)
+	}
+
+	local := now.In(r.Location)
+	year, month, day := local.Date()
+	midnight := time.Date(year, month, day, 0, 0, 0, 0, r.Location)
+
+	switch r.unit {
+	case "mo":
+		// 从1970年1月开始按N个月分段
+		months := (year-1970)*12 + int(month) - 1
+		months -= floorMod(months, r.unitCount)
+		start := time.Date(1970, time.Month(months+1), 1, 0, 0, 0, 0, r.Location)
+		return start, start.AddDate(0, r.unitCount, 0)
+	case "w":
+		// 以周一0点为边界，从1970-01-05（周一）开始按N周分段
+		days := civilDays(year, month, day)
+		weeks := floorDiv(days-4, 7)
+		weeks -= floorMod(weeks, r.unitCount)
+		start := time.Date(1970, time.January, 5+weeks*7, 0, 0, 0, 0, r.Location)
+		return start, start.AddDate(0, 0, 7*r.unitCount)
+	case "d":
+		days := civilDays(year, month, day)
+		days -= floorMod(days, r.unitCount)
+		start := time.Date(1970, time.January, 1+days, 0, 0, 0, 0, r.Location)
+		return start, start.AddDate(0, 0, r.unitCount)
+	default:
+		// 小于一天的窗口从当天0点开始分段
+		elapsed := local.Sub(midnight)
+		start := midnight.Add(elapsed - elapsed%r.Window)
+		return start, start.Add(r.Window)
+	}
+}
+
+// Bucket 返回now所在窗口的标识，对齐窗口的计数器键按窗口分桶；非对齐窗口返回空字符串
+func (r *LimitRule) Bucket(now time.Time) string {
+	if !r.Aligned {
+		return ""
+	}
+	start, _ := r.Period(now)
+	return start.Format("20060102T1504")
+}
+
+// WindowText 返回窗口长度的中文描述，如 "3小时"、"1小时30分钟"、"1个月"
+func (r *LimitRule) WindowText() string {
+	var b strings.Builder
+	if r.Months > 0 {
+		fmt.Fprintf(&b, "%d个月", r.Months)
+	}
+	rest := r.Window
+	for _, unit := range durationUnits {
+		if unit.length == 0 || rest < unit.length {
+			continue
+		}
+		fmt.Fprintf(&b, "%d%s", rest/unit.length, unit.name)
+		rest %= unit.length
+	}
+	return b.String()
+}
+
+// ResetTime 返回当前窗口的重置时间
+// 对齐窗口为窗口结束时间；非对齐窗口由计数器剩余的生存时间决定，ttl<=0表示窗口尚未开始
+func (r *LimitRule) ResetTime(now time.Time, ttl time.Duration) (time.Time, bool) {
+	if r.Aligned {
+		_, end := r.Period(now)
+		return end, true
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(ttl).Truncate(time.Second), true
+}
+
+// ResetTimeText 返回重置时间的展示文本，如 "2024-08-08 00:00:00 CST"
+func (r *LimitRule) ResetTimeText(resetAt time.Time) string {
+	loc := r.Location
+	if loc == nil {
+		loc = defaultLocation()
+	}
+	return resetAt.In(loc).Format("2006-01-02 15:04:05 MST")
+}
+
+// defaultLocation 返回配置的默认时区
+func defaultLocation() *time.Location {
+	loc, err := time.LoadLocation(config.GetConfig().Policies.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// civilDays 返回日期距1970-01-01的天数，与时区和夏令时无关
+func civilDays(year int, month time.Month, day int) int {
+	return int(time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+// floorDiv 向下取整的除法
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// floorMod 结果非负的取模
+func floorMod(a, b int) int {
+	return a - floorDiv(a, b)*b
+}
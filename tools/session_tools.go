@@ -0,0 +1,232 @@
+package tools
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// ErrSigningDisabled 没有配置 auth.hmac_secret，不能签发签名token
+var ErrSigningDisabled = errors.New("未配置签名密钥")
+
+// jwtHeader 服务签发和接受的JWT头，只支持HS256
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// sessionVerifyScript 校验用户的会话token是否存在且未过期，需要时滑动续期
+// KEYS[1] 用户的所有会话（有序集合，成员为token的SHA-256，分数为过期的毫秒时间）
+// ARGV: 当前毫秒时间、token的SHA-256、是否续期(0/1)、续期后的过期毫秒时间
+// 返回: 1 有效，0 不存在或已过期
+var sessionVerifyScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local expireAt = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if not expireAt then
+	return 0
+end
+if tonumber(expireAt) <= now then
+	redis.call('ZREM', KEYS[1], ARGV[2])
+	return 0
+end
+if ARGV[3] == '1' and tonumber(ARGV[4]) > tonumber(expireAt) then
+	redis.call('ZADD', KEYS[1], 'XX', ARGV[4], ARGV[2])
+	local pttl = redis.call('PTTL', KEYS[1])
+	if pttl >= 0 and now + pttl < tonumber(ARGV[4]) then
+		redis.call('PEXPIREAT', KEYS[1], ARGV[4])
+	end
+end
+return 1
+`)
+
+// sessionCreateScript 添加一个会话，清理已过期的会话，超过上限时淘汰最早过期的会话
+// KEYS[1] 用户的所有会话
+// ARGV: 当前毫秒时间、token的SHA-256、过期的毫秒时间、会话数上限（0表示不限制）
+var sessionCreateScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2])
+local max = tonumber(ARGV[4])
+local count = redis.call('ZCARD', KEYS[1])
+if max > 0 and count > max then
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, count - max - 1)
+end
+-- 集合在最晚过期的会话之后过期
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+redis.call('PEXPIREAT', KEYS[1], last[2])
+return 1
+`)
+
+// tokenClaims 签名token中的声明
+type tokenClaims struct {
+	Subject   string `json:"sub"` // 用户ID
+	ExpiresAt int64  `json:"exp"` // 过期时间，Unix秒
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+// verifyToken 校验用户token，依次尝试：
+//   - 签名token：配置了 auth.hmac_secret 时在本地校验签名、用户和有效期，不访问Redis
+//   - 旧的单一token：与 xtoken_{userid} 比较，按 auth.sliding 续期
+//   - 会话token：用户的会话集合中存在且未过期，按 auth.sliding 续期
+//
+// 所有比较都是常量时间的
+func verifyToken(xuserid, xtoken string) (bool, error) {
+	if xuserid == "" || xtoken == "" {
+		return false, nil
+	}
+	cfg := config.GetConfig().Auth
+	now := time.Now()
+
+	if cfg.HMACSecret != "" {
+		if valid, recognized := verifySignedToken([]byte(cfg.HMACSecret), xuserid, xtoken, now); recognized {
+			return valid, nil
+		}
+	}
+
+	// 大部分用户仍然使用旧的单一token，先查询它，命中时只需要一次Redis往返
+	tokenKey := keys.Token(xuserid)
+	expectedToken, err := RedisClient.GetString(tokenKey)
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if err == nil && subtle.ConstantTimeCompare([]byte(xtoken), []byte(expectedToken)) == 1 {
+		if cfg.Sliding {
+			// 只延长本来就有过期时间的token，不给永久有效的token加上过期时间
+			if ttl, err := RedisClient.TTL(tokenKey); err == nil && ttl > 0 && ttl < cfg.SessionTTL {
+				if err := RedisClient.Expire(tokenKey, cfg.SessionTTL); err != nil {
+					fmt.Printf("延长用户 %s 的token有效期失败: %v\n", xuserid, err)
+				}
+			}
+		}
+		return true, nil
+	}
+
+	sliding := 0
+	if cfg.Sliding {
+		sliding = 1
+	}
+	result, err := RedisClient.RunScript(sessionVerifyScript, []string{keys.Sessions(xuserid)},
+		now.UnixMilli(), hashToken(xtoken), sliding, now.Add(cfg.SessionTTL).UnixMilli())
+	if err != nil {
+		return false, fmt.Errorf("校验会话失败: %w", err)
+	}
+	valid, ok := result.(int64)
+	if !ok {
+		return false, fmt.Errorf("校验会话脚本返回值格式错误: %v", result)
+	}
+	return valid == 1, nil
+}
+
+// verifySignedToken 在本地校验签名token，支持两种格式：
+//   - JWT: header.payload.signature，只接受HS256
+//   - HMAC签名: payload.signature
+//
+// payload为base64url编码的 tokenClaims，signature为HMAC-SHA256
+// 返回: (是否有效, 是否为签名正确的签名token)，recognized为false时需要继续按其他方式校验
+func verifySignedToken(secret []byte, xuserid, xtoken string, now time.Time) (valid, recognized bool) {
+	parts := strings.Split(xtoken, ".")
+	var signingInput, payload, signature string
+	switch len(parts) {
+	case 3:
+		header, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false, false
+		}
+		var fields struct {
+			Alg string `json:"alg"`
+		}
+		if json.Unmarshal(header, &fields) != nil || fields.Alg != "HS256" {
+			return false, false
+		}
+		signingInput, payload, signature = parts[0]+"."+parts[1], parts[1], parts[2]
+	case 2:
+		signingInput, payload, signature = parts[0], parts[0], parts[1]
+	default:
+		return false, false
+	}
+
+	actual, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || subtle.ConstantTimeCompare(actual, signToken(secret, signingInput)) != 1 {
+		return false, false
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false, true
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return false, true
+	}
+	unix := now.Unix()
+	valid = claims.Subject == xuserid && claims.ExpiresAt > unix && claims.NotBefore <= unix
+	return valid, true
+}
+
+// signToken 计算签名
+func signToken(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// hashToken 会话集合中只保存token的SHA-256，Redis中的数据泄露时不会泄露token
+func hashToken(xtoken string) string {
+	sum := sha256.Sum256([]byte(xtoken))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueSignedToken 为用户签发JWT（HS256），有效期为 auth.session_ttl
+// 签名token在本地校验，过期之前不能单独吊销，只能通过更换 auth.hmac_secret 使所有签名token失效
+func IssueSignedToken(xuserid string) (string, time.Time, error) {
+	cfg := config.GetConfig().Auth
+	if cfg.HMACSecret == "" {
+		return "", time.Time{}, ErrSigningDisabled
+	}
+	now := time.Now()
+	expiresAt := now.Add(cfg.SessionTTL)
+	payload, err := json.Marshal(tokenClaims{Subject: xuserid, ExpiresAt: expiresAt.Unix(), IssuedAt: now.Unix()})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("序列化token失败: %w", err)
+	}
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(signToken([]byte(cfg.HMACSecret), signingInput))
+	return signingInput + "." + signature, expiresAt, nil
+}
+
+// CreateSession 为用户创建一个新的会话token，与用户已有的会话同时有效
+// 有效期为 auth.session_ttl，会话数超过 auth.max_sessions 时淘汰最早过期的会话
+func CreateSession(xuserid string) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, fmt.Errorf("生成会话token失败: %w", err)
+	}
+	xtoken := hex.EncodeToString(buf)
+
+	cfg := config.GetConfig().Auth
+	now := time.Now()
+	expiresAt := now.Add(cfg.SessionTTL)
+	if _, err := RedisClient.RunScript(sessionCreateScript, []string{keys.Sessions(xuserid)},
+		now.UnixMilli(), hashToken(xtoken), expiresAt.UnixMilli(), cfg.MaxSessions); err != nil {
+		return "", time.Time{}, fmt.Errorf("保存会话失败: %w", err)
+	}
+	return xtoken, expiresAt, nil
+}
+
+// RevokeSessions 吊销用户的所有会话和旧的单一token，签名token不受影响
+func RevokeSessions(xuserid string) error {
+	for _, key := range []string{keys.Sessions(xuserid), keys.Token(xuserid)} {
+		if err := RedisClient.Delete(key); err != nil {
+			return fmt.Errorf("吊销会话失败: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// 超过账号共享检测上限时的处理方式
+const (
+	SharingFlag  = "flag"  // 只记录到日志
+	SharingBlock = "block" // 拒绝请求，直到窗口内的IP或设备数回落到上限以内
+)
+
+// UserDeniedShared 用户在窗口内使用的IP或设备过多，请求被拒绝，返回给前端用于区分提示
+const UserDeniedShared = "user_shared"
+
+// maxDeviceLength 记录的设备标识（User-Agent）的最大字节数
+const maxDeviceLength = 256
+
+// sharingDetectionLogSize 每个用户保留的超过账号共享检测上限的记录条数
+const sharingDetectionLogSize = 100
+
+// sharingDetectionTTL 超过上限的记录在用户最后一次超过上限之后的保存时间
+const sharingDetectionTTL = 30 * 24 * time.Hour
+
+// sharingScript 记录用户本次请求的IP和设备，返回窗口内不同IP和设备的数量
+// KEYS[1] 最近使用的IP，KEYS[2] 最近使用的设备（都是有序集合，分数为最后一次使用的时间）
+// ARGV: 当前毫秒时间、窗口毫秒数、IP、设备
+// 返回: {IP数, 设备数}
+var sharingScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local counts = {}
+for i = 1, 2 do
+	redis.call('ZREMRANGEBYSCORE', KEYS[i], '-inf', now - window)
+	redis.call('ZADD', KEYS[i], now, ARGV[i + 2])
+	redis.call('PEXPIRE', KEYS[i], window)
+	counts[i] = redis.call('ZCARD', KEYS[i])
+end
+return counts
+`)
+
+// SharingRule 套餐等级的账号共享检测上限，0表示不限制
+type SharingRule struct {
+	IPs     int    `json:"ips"`     // 窗口内不同IP的数量上限
+	Devices int    `json:"devices"` // 窗口内不同设备（User-Agent）的数量上限
+	Action  string `json:"action"`  // 超过上限时的处理: flag（默认）、block
+}
+
+// buildSharingRules 校验并加载按套餐等级配置的账号共享检测上限
+func buildSharingRules(data map[string]*SharingRule) (map[string]SharingRule, []string) {
+	result := make(map[string]SharingRule, len(data))
+	var errs []string
+	for _, level := range sortedKeys(data) {
+		rule := data[level]
+		if rule == nil {
+			errs = append(errs, fmt.Sprintf("sharing.%s: 规则不能为空", level))
+			continue
+		}
+		if rule.IPs < 0 || rule.Devices < 0 {
+			errs = append(errs, fmt.Sprintf("sharing.%s: ips 和 devices 不能为负数", level))
+			continue
+		}
+		normalized := *rule
+		switch normalized.Action {
+		case "":
+			normalized.Action = SharingFlag
+		case SharingFlag, SharingBlock:
+		default:
+			errs = append(errs, fmt.Sprintf("sharing.%s.action: 只能是 %s 或 %s，当前为 %q", level, SharingFlag, SharingBlock, rule.Action))
+			continue
+		}
+		result[strings.ToLower(level)] = normalized
+	}
+	return result, errs
+}
+
+// sharingRule 返回套餐等级的账号共享检测上限，未配置的等级使用 "*" 的上限，都没有配置时不检测
+func (s *limitSet) sharingRule(level string) (SharingRule, bool) {
+	if rule, exists := s.sharing[level]; exists {
+		return rule, true
+	}
+	rule, exists := s.sharing["*"]
+	return rule, exists
+}
+
+// SharingSignal 用户在窗口内使用的IP和设备数，以及是否超过套餐的上限
+type SharingSignal struct {
+	IPs      int64       `json:"ips"`
+	Devices  int64       `json:"devices"`
+	Rule     SharingRule `json:"rule"`
+	Exceeded bool        `json:"exceeded"`
+	Action   string      `json:"action,omitempty"` // 超过上限时的处理，见 Sharing* 常量
+}
+
+// Blocked 判断请求是否因为账号共享被拒绝
+func (s *SharingSignal) Blocked() bool {
+	return s != nil && s.Exceeded && s.Action == SharingBlock
+}
+
+// SharingDetection 一次超过账号共享检测上限的请求，保存在用户的记录中供管理员查看
+type SharingDetection struct {
+	Time     time.Time `json:"time"`
+	Product  string    `json:"product"`
+	Level    string    `json:"level"`
+	ClientIP string    `json:"client_ip"`
+	Device   string    `json:"device"`
+	IPs      int64     `json:"ips"`
+	Devices  int64     `json:"devices"`
+	Action   string    `json:"action"`
+}
+
+// truncateDevice 把设备标识截断到 maxDeviceLength 字节以内，不拆分多字节字符
+func truncateDevice(device string) string {
+	if len(device) <= maxDeviceLength {
+		return device
+	}
+	end := maxDeviceLength
+	for end > 0 && !utf8.RuneStart(device[end]) {
+		end--
+	}
+	return device[:end]
+}
+
+// CheckSharing 记录用户本次请求的IP和设备，按用户在请求产品下生效的套餐等级判断是否超过账号共享检测的上限
+// 统计窗口由 policies.sharing_window 配置；套餐等级没有配置上限时返回nil
+// 超过上限时输出 [账号共享] 日志并写入用户的记录，记录写入失败只输出日志
+func CheckSharing(pkg *UserPackage, clientIP, userAgent string) (*SharingSignal, error) {
+	rule, exists := currentLimits().sharingRule(pkg.Level)
+	if !exists || (rule.IPs == 0 && rule.Devices == 0) {
+		return nil, nil
+	}
+
+	device := truncateDevice(strings.TrimSpace(userAgent))
+	if device == "" {
+		device = "unknown"
+	}
+	window := config.GetConfig().Policies.SharingWindow
+	result, err := RedisClient.RunScript(sharingScript,
+		[]string{keys.UserIPs(pkg.UserID), keys.UserDevices(pkg.UserID)},
+		time.Now().UnixMilli(), window.Milliseconds(), clientIP, device)
+	if err != nil {
+		return nil, fmt.Errorf("记录用户IP和设备失败: %w", err)
+	}
+	counts, ok := result.([]interface{})
+	if !ok || len(counts) != 2 {
+		return nil, fmt.Errorf("账号共享检测脚本返回值格式错误: %v", result)
+	}
+
+	signal := &SharingSignal{Rule: rule}
+	signal.IPs, _ = counts[0].(int64)
+	signal.Devices, _ = counts[1].(int64)
+	signal.Exceeded = (rule.IPs > 0 && signal.IPs > int64(rule.IPs)) ||
+		(rule.Devices > 0 && signal.Devices > int64(rule.Devices))
+	if signal.Exceeded {
+		signal.Action = rule.Action
+		detection := SharingDetection{
+			Time:     time.Now(),
+			Product:  pkg.Product,
+			Level:    pkg.Level,
+			ClientIP: clientIP,
+			Device:   device,
+			IPs:      signal.IPs,
+			Devices:  signal.Devices,
+			Action:   signal.Action,
+		}
+		if err := recordSharingDetection(pkg.UserID, detection); err != nil {
+			fmt.Printf("记录用户 %s 的账号共享失败: %v\n", pkg.UserID, err)
+		}
+	}
+	return signal, nil
+}
+
+// recordSharingDetection 输出超过账号共享检测上限的日志，并写入用户最近 sharingDetectionLogSize 条记录
+func recordSharingDetection(xuserid string, detection SharingDetection) error {
+	fmt.Printf("[账号共享] 用户=%s 套餐=%s IP=%s %s内使用了%d个IP、%d个设备，处理=%s\n",
+		xuserid, detection.Level, detection.ClientIP, config.GetConfig().Policies.SharingWindow, detection.IPs, detection.Devices, detection.Action)
+
+	data, err := json.Marshal(detection)
+	if err != nil {
+		return fmt.Errorf("序列化账号共享记录失败: %w", err)
+	}
+	key := keys.UserSharing(xuserid)
+	if err := RedisClient.LPush(key, string(data)); err != nil {
+		return fmt.Errorf("写入账号共享记录失败: %w", err)
+	}
+	if err := RedisClient.LTrim(key, 0, sharingDetectionLogSize-1); err != nil {
+		return fmt.Errorf("裁剪账号共享记录失败: %w", err)
+	}
+	if err := RedisClient.Expire(key, sharingDetectionTTL); err != nil {
+		return fmt.Errorf("设置账号共享记录过期时间失败: %w", err)
+	}
+	return nil
+}
+
+// SharingUsage 用户在窗口内使用过的一个IP或设备
+type SharingUsage struct {
+	Value    string    `json:"value"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// SharingReport 用户在窗口内使用过的所有IP和设备，以及最近超过上限的记录，最近的在前
+type SharingReport struct {
+	UserID     string             `json:"user_id"`
+	Window     string             `json:"window"`
+	IPs        []SharingUsage     `json:"ips"`
+	Devices    []SharingUsage     `json:"devices"`
+	Detections []SharingDetection `json:"detections"`
+}
+
+// GetSharingReport 返回用户在窗口内使用过的IP和设备以及超过上限的记录，供管理员排查账号共享
+func GetSharingReport(xuserid string) (*SharingReport, error) {
+	window := config.GetConfig().Policies.SharingWindow
+	from := time.Now().Add(-window).UnixMilli()
+	report := &SharingReport{UserID: xuserid, Window: window.String()}
+
+	var err error
+	if report.IPs, err = sharingUsage(keys.UserIPs(xuserid), from); err != nil {
+		return nil, err
+	}
+	if report.Devices, err = sharingUsage(keys.UserDevices(xuserid), from); err != nil {
+		return nil, err
+	}
+	if report.Detections, err = sharingDetections(xuserid); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sharingDetections 读取用户最近超过账号共享检测上限的记录，最新的在前
+func sharingDetections(xuserid string) ([]SharingDetection, error) {
+	values, err := RedisClient.LRange(keys.UserSharing(xuserid), 0, sharingDetectionLogSize-1)
+	if err != nil {
+		return nil, fmt.Errorf("获取账号共享记录失败: %w", err)
+	}
+	detections := make([]SharingDetection, 0, len(values))
+	for _, value := range values {
+		var detection SharingDetection
+		if err := json.Unmarshal([]byte(value), &detection); err != nil {
+			fmt.Printf("账号共享记录格式错误，已忽略: %v\n", err)
+			continue
+		}
+		detections = append(detections, detection)
+	}
+	return detections, nil
+}
+
+// sharingUsage 读取有序集合中分数不早于from的成员
+func sharingUsage(key string, from int64) ([]SharingUsage, error) {
+	members, err := RedisClient.ZRevRangeWithScores(key)
+	if err != nil {
+		return nil, fmt.Errorf("获取用户IP和设备失败: %w", err)
+	}
+	usage := make([]SharingUsage, 0, len(members))
+	for _, member := range members {
+		if int64(member.Score) < from {
+			continue
+		}
+		value, _ := member.Member.(string)
+		usage = append(usage, SharingUsage{Value: value, LastSeen: time.UnixMilli(int64(member.Score))})
+	}
+	return usage, nil
+}
@@ -0,0 +1,38 @@
+package tools
+
+import (
+	"unicode"
+)
+
+// latinCharsPerToken 英文、数字等连续字符大约每4个字符计为1个token
+const latinCharsPerToken = 4
+
+// EstimateTokens 估算提问内容的token数，不依赖具体模型的分词器
+//   - 中日韩文字每个字符计为1个token
+//   - 连续的字母和数字每4个字符计为1个token，不足4个按1个计
+//   - 其他标点符号每个计为1个token，空白字符不计
+func EstimateTokens(text string) int {
+	tokens := 0
+	run := 0
+	flush := func() {
+		tokens += (run + latinCharsPerToken - 1) / latinCharsPerToken
+		run = 0
+	}
+
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			run++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
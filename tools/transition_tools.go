@@ -0,0 +1,292 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// counterIndexEntry 计数器索引中记录的计数器信息，用于套餐迁移和管理接口
+type counterIndexEntry struct {
+	Product string `json:"product"`
+	Package string `json:"package"`
+	Name    string `json:"name"` // 计数器键中的名称：模型名、通配模式、group:组名 或 credits
+	Unit    string `json:"unit"`
+	Limit   int64  `json:"limit"` // 记录时的上限，与计数器使用相同的存储单位
+}
+
+// indexEntry 返回计数器在索引中的记录
+func (c *limitCounter) indexEntry(product, packageType string) (string, error) {
+	entry, err := json.Marshal(counterIndexEntry{
+		Product: product,
+		Package: packageType,
+		Name:    c.counterName,
+		Unit:    c.unit,
+		Limit:   c.max(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("序列化计数器索引失败: %w", err)
+	}
+	return string(entry), nil
+}
+
+// extendCounterIndex 需要时延长计数器索引的过期时间，使索引不早于其中最晚过期的计数器过期
+// 参数: ttl - 索引中最晚过期的计数器的剩余时间，不大于0时不处理
+func extendCounterIndex(indexKey string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	if current, err := RedisClient.TTL(indexKey); err != nil || current >= ttl {
+		return nil
+	}
+	if err := RedisClient.Expire(indexKey, ttl); err != nil {
+		return fmt.Errorf("更新计数器索引过期时间失败: %w", err)
+	}
+	return nil
+}
+
+// readCounterIndex 读取用户的计数器索引，键为计数器的Redis键
+func readCounterIndex(xuserid string) (map[string]counterIndexEntry, error) {
+	fields, err := RedisClient.HGetAll(keys.RateLimitIndex(xuserid))
+	if err != nil {
+		return nil, fmt.Errorf("获取计数器索引失败: %w", err)
+	}
+	entries := make(map[string]counterIndexEntry, len(fields))
+	for key, value := range fields {
+		var entry counterIndexEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			fmt.Printf("计数器索引 %s 格式错误，已忽略: %v\n", key, err)
+			continue
+		}
+		entries[key] = entry
+	}
+	return entries, nil
+}
+
+// namedCounters 返回套餐中与指定名称对应的所有计数器，套餐中没有对应规则时返回nil
+func namedCounters(product, packageType, name, xuserid string, overrides userOverrides, now time.Time) []*limitCounter {
+	switch {
+	case name == CreditsRuleKey:
+		rule, override := creditsRule(product, packageType, overrides)
+		if rule == nil {
+			return nil
+		}
+		return []*limitCounter{{
+			name:        CreditsRuleKey,
+			counterName: CreditsRuleKey,
+			unit:        UnitCredit,
+			rule:        rule,
+			key:         counterKey(rule, xuserid, product, packageType, CreditsRuleKey, now),
+			override:    override,
+		}}
+	case strings.HasPrefix(name, GroupRulePrefix):
+		group := strings.TrimPrefix(name, GroupRulePrefix)
+		var rules RuleList
+		if packageRules := currentLimits().packageRules(product, packageType); packageRules != nil {
+			rules = packageRules.groups[group]
+		}
+		rules, override := overrides.apply(rules, name)
+		return ruleCounters(rules, override, group, group, name, xuserid, product, packageType, 0, now)
+	default:
+		resolved := getLimitRules(product, packageType, name, overrides)
+		if resolved == nil {
+			return nil
+		}
+		return ruleCounters(resolved.Rules, resolved.Override, resolved.RuleKey, "", resolved.counterName(), xuserid, product, packageType, 0, now)
+	}
+}
+
+// counterForName 返回套餐中与指定名称和计量单位对应的计数器，套餐中没有对应规则时返回nil
+func counterForName(product, packageType, name, unit, xuserid string, overrides userOverrides, now time.Time) *limitCounter {
+	for _, counter := range namedCounters(product, packageType, name, xuserid, overrides, now) {
+		if counter.unit == unit {
+			return counter
+		}
+	}
+	return nil
+}
+
+// derivedCounterIndex 按套餐的规则推导用户在该套餐下已存在的计数器，用于索引中没有记录的计数器，如索引上线之前创建的计数器
+// 套餐中配置的模型、通配模式、共享额度组和积分额度都会检查；按兜底规则以模型名记录的计数器无法推导，会在窗口结束后自然过期
+func derivedCounterIndex(product, packageType, xuserid string, overrides userOverrides, now time.Time) (map[string]counterIndexEntry, error) {
+	entries := make(map[string]counterIndexEntry)
+	packageRules := currentLimits().packageRules(product, packageType)
+	if packageRules == nil {
+		return entries, nil
+	}
+
+	names := sortedKeys(packageRules.exact)
+	for _, pattern := range packageRules.patterns {
+		names = append(names, pattern.pattern)
+	}
+	for _, group := range sortedKeys(packageRules.groups) {
+		names = append(names, GroupRulePrefix+group)
+	}
+	names = append(names, CreditsRuleKey)
+
+	for _, name := range names {
+		for _, counter := range namedCounters(product, packageType, name, xuserid, overrides, now) {
+			if _, exists := entries[counter.key]; exists {
+				continue
+			}
+			exists, err := RedisClient.Exists(counter.key)
+			if err != nil {
+				return nil, fmt.Errorf("检查旧套餐计数器失败: %w", err)
+			}
+			if exists {
+				entries[counter.key] = counterIndexEntry{
+					Product: product,
+					Package: packageType,
+					Name:    counter.counterName,
+					Unit:    counter.unit,
+					Limit:   counter.max(),
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// transitionValue 按迁移策略计算新计数器的初始值，不超过新计数器的上限
+func transitionValue(policy string, used, oldLimit, newLimit int64) int64 {
+	var value int64
+	switch policy {
+	case config.TransitionCarry:
+		value = used
+	case config.TransitionScale:
+		if oldLimit <= 0 {
+			value = newLimit
+		} else {
+			value = int64(math.Round(float64(used) * float64(newLimit) / float64(oldLimit)))
+		}
+	}
+	if value > newLimit {
+		value = newLimit
+	}
+	return value
+}
+
+// transitionPackage 用户在产品下的套餐发生变化时，按配置的策略把旧套餐所有计数器的使用量迁移到新套餐，并删除旧套餐的计数器
+//   - reset: 新套餐的计数器从0开始
+//   - carry: 沿用旧套餐已使用的次数
+//   - scale: 按旧套餐的使用比例折算，如旧套餐 10/15 升级到上限60的套餐后为 40/60
+//
+// 迁移后的计数器沿用旧计数器的剩余时间（不超过新规则的窗口），多个旧计数器对应同一个新计数器时取较大值；
+// 索引中没有旧套餐的计数器时按旧套餐的规则推导，见 derivedCounterIndex
+func transitionPackage(xuserid, product, oldPackage, newPackage string, overrides userOverrides, now time.Time) error {
+	policy := config.GetConfig().Policies.PackageTransition
+	entries, err := readCounterIndex(xuserid)
+	if err != nil {
+		return err
+	}
+	indexed := false
+	for _, entry := range entries {
+		if entry.Product == product && entry.Package == oldPackage {
+			indexed = true
+			break
+		}
+	}
+	if !indexed {
+		// 索引中没有旧套餐的计数器时按旧套餐的规则推导
+		derived, err := derivedCounterIndex(product, oldPackage, xuserid, overrides, now)
+		if err != nil {
+			return err
+		}
+		for key, entry := range derived {
+			entries[key] = entry
+		}
+	}
+
+	type migrated struct {
+		counter *limitCounter
+		value   int64
+		ttl     time.Duration
+	}
+	targets := make(map[string]*migrated)
+	var oldKeys []string
+	for _, key := range sortedKeys(entries) {
+		entry := entries[key]
+		if entry.Product != product || entry.Package != oldPackage {
+			continue
+		}
+		oldKeys = append(oldKeys, key)
+		if policy == config.TransitionReset {
+			continue
+		}
+
+		used, err := RedisClient.GetInt(key)
+		if err == redis.Nil || (err == nil && used <= 0) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("获取旧套餐计数失败: %w", err)
+		}
+		ttl, err := RedisClient.TTL(key)
+		if err != nil {
+			return fmt.Errorf("获取旧套餐计数器过期时间失败: %w", err)
+		}
+
+		counter := counterForName(product, newPackage, entry.Name, entry.Unit, xuserid, overrides, now)
+		if counter == nil {
+			continue
+		}
+		value := transitionValue(policy, int64(used), entry.Limit, counter.max())
+		_, periodEnd := counter.rule.Period(now)
+		if window := periodEnd.Sub(now); ttl <= 0 || ttl > window {
+			ttl = window
+		}
+		if target, exists := targets[counter.key]; !exists || value > target.value {
+			targets[counter.key] = &migrated{counter: counter, value: value, ttl: ttl}
+		}
+	}
+
+	indexKey := keys.RateLimitIndex(xuserid)
+	var indexTTL time.Duration
+	for _, key := range sortedKeys(targets) {
+		target := targets[key]
+		if target.value <= 0 {
+			continue
+		}
+		// 新套餐的计数器已存在时（如之前使用过该套餐）保留较大的值
+		if existing, err := RedisClient.GetInt(key); err == nil && int64(existing) >= target.value {
+			continue
+		}
+		if err := RedisClient.Set(key, target.value, target.ttl); err != nil {
+			return fmt.Errorf("迁移计数器失败: %w", err)
+		}
+		entry, err := target.counter.indexEntry(product, newPackage)
+		if err != nil {
+			return err
+		}
+		if err := RedisClient.HSet(indexKey, key, entry); err != nil {
+			return fmt.Errorf("更新计数器索引失败: %w", err)
+		}
+		if target.ttl > indexTTL {
+			indexTTL = target.ttl
+		}
+	}
+	// 索引不能早于迁移后的计数器过期
+	if err := extendCounterIndex(indexKey, indexTTL); err != nil {
+		return err
+	}
+
+	for _, key := range oldKeys {
+		if err := RedisClient.Delete(key); err != nil {
+			return fmt.Errorf("删除旧套餐计数器失败: %w", err)
+		}
+	}
+	if len(oldKeys) > 0 {
+		if err := RedisClient.HDel(indexKey, oldKeys...); err != nil {
+			return fmt.Errorf("更新计数器索引失败: %w", err)
+		}
+	}
+
+	fmt.Printf("用户 %s 在产品 %s 的套餐从 %s 变为 %s，按 %s 策略迁移了 %d 个计数器，删除了 %d 个旧计数器\n",
+		xuserid, product, oldPackage, newPackage, policy, len(targets), len(oldKeys))
+	return nil
+}
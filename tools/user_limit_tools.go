@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"limit_service/config"
+)
+
+// UserDeniedBusy 用户同时处理的请求数已达套餐上限，返回给前端用于区分提示
+const UserDeniedBusy = "user_busy"
+
+// userSlotScript 原子地检查并占用用户的并发名额
+// KEYS[1] 用户正在处理的请求（有序集合，分数为名额的过期时间）
+// ARGV: 当前毫秒时间、并发上限、名额ID、名额过期的毫秒时间
+// 返回: 1 成功，0 超过并发
+var userSlotScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[4], ARGV[3])
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl < 0 or now + pttl < tonumber(ARGV[4]) then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[4])
+end
+return 1
+`)
+
+// buildUserConcurrency 校验并加载按套餐等级配置的用户并发上限，0表示不限制
+func buildUserConcurrency(data map[string]int) (map[string]int, []string) {
+	result := make(map[string]int, len(data))
+	var errs []string
+	for _, level := range sortedKeys(data) {
+		if data[level] < 0 {
+			errs = append(errs, fmt.Sprintf("user_concurrency.%s: 并发上限不能为负数", level))
+			continue
+		}
+		result[strings.ToLower(level)] = data[level]
+	}
+	return result, errs
+}
+
+// userConcurrencyLimit 返回套餐等级的用户并发上限，未配置的等级使用 "*" 的上限，都没有配置时不限制
+func (s *limitSet) userConcurrencyLimit(level string) int {
+	if limit, exists := s.userConcurrency[level]; exists {
+		return limit
+	}
+	return s.userConcurrency["*"]
+}
+
+// AcquireUserSlot 为一次请求占用用户的并发名额，上限按用户在请求产品下生效的套餐等级
+// 返回: (名额ID, 是否占用成功, 错误)，套餐没有并发上限时名额ID为空
+// 名额需要在请求完成后通过 ReleaseUserSlot 释放，没有释放的名额在 policies.user_lease_timeout 后自动失效；
+// 未配置 service.token 时不限制，见 concurrencyEnabled
+func AcquireUserSlot(pkg *UserPackage) (string, bool, error) {
+	limit := currentLimits().userConcurrencyLimit(pkg.Level)
+	if limit == 0 || !concurrencyEnabled() {
+		return "", true, nil
+	}
+
+	leaseID, err := randomID()
+	if err != nil {
+		return "", false, err
+	}
+	now := time.Now()
+	expireAt := now.Add(config.GetConfig().Policies.UserLeaseTimeout)
+	result, err := RedisClient.RunScript(userSlotScript, []string{keys.UserInflight(pkg.UserID)},
+		now.UnixMilli(), limit, leaseID, expireAt.UnixMilli())
+	if err != nil {
+		return "", false, fmt.Errorf("检查用户并发失败: %w", err)
+	}
+	acquired, ok := result.(int64)
+	if !ok {
+		return "", false, fmt.Errorf("用户并发脚本返回值格式错误: %v", result)
+	}
+	if acquired == 0 {
+		return "", false, nil
+	}
+	return leaseID, true, nil
+}
+
+// ReleaseUserSlot 释放请求占用的用户并发名额，返回名额是否存在（已释放或已过期时为false）
+func ReleaseUserSlot(xuserid, leaseID string) (bool, error) {
+	if leaseID == "" {
+		return false, nil
+	}
+	removed, err := RedisClient.ZRem(keys.UserInflight(xuserid), leaseID)
+	if err != nil {
+		return false, fmt.Errorf("释放用户并发名额失败: %w", err)
+	}
+	return removed > 0, nil
+}